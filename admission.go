@@ -0,0 +1,198 @@
+package sse
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ErrStopReconnect returned by Authenticator rejects consumer with status 204,
+// browser does not reconnect after it
+var ErrStopReconnect = errors.New("sse: stop reconnecting")
+
+// A RejectReason represents a reason of rejection consumer
+type RejectReason int
+
+const (
+	// RejectInternal is writer without flushing, status 500
+	RejectInternal RejectReason = iota
+	// RejectUnauthorized is error of Authenticator, status 401 or 403
+	RejectUnauthorized
+	// RejectStopReconnect is ErrStopReconnect of Authenticator, status 204
+	RejectStopReconnect
+	// RejectStreamNotFound is unknown stream of ConsumerOptions, status 404
+	RejectStreamNotFound
+	// RejectDuplicate is connected CID without MultipleConnections, status 409
+	RejectDuplicate
+	// RejectShutdown is closed side event, status 503
+	RejectShutdown
+	// RejectRateLimited is exceeded ConnectRate, status 503
+	RejectRateLimited
+	// RejectFull is exceeded limit of connections, status 503
+	RejectFull
+)
+
+// String returns name of reason
+func (r RejectReason) String() string {
+	switch r {
+	case RejectInternal:
+		return "internal"
+	case RejectUnauthorized:
+		return "unauthorized"
+	case RejectStopReconnect:
+		return "stop reconnect"
+	case RejectStreamNotFound:
+		return "stream not found"
+	case RejectDuplicate:
+		return "duplicate"
+	case RejectShutdown:
+		return "shutdown"
+	case RejectRateLimited:
+		return "rate limited"
+	case RejectFull:
+		return "full"
+	}
+	return "unknown"
+}
+
+// A Rejection represents a information about rejected consumer, Code - status
+// of response, RetryAfter - value of header Retry-After, zero is not sent,
+// Err - error of Authenticator
+type Rejection struct {
+	CID        interface{}
+	Reason     RejectReason
+	Code       int
+	RetryAfter time.Duration
+	Err        error
+}
+
+// writeRejection writes default response of rejection
+func writeRejection(w http.ResponseWriter, r *http.Request, rej *Rejection) {
+	if rej.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rej.RetryAfter.Seconds()))))
+	}
+	if rej.Code == http.StatusNoContent {
+		w.WriteHeader(rej.Code)
+		return
+	}
+	text := http.StatusText(rej.Code)
+	if rej.Reason == RejectStreamNotFound {
+		text = "stream not found"
+	}
+	http.Error(w, text, rej.Code)
+}
+
+// A tokenBucket represents a limiter with rate of tokens per second and
+// capacity burst. It is not safe for concurrent use
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates full bucket, burst less than 1 is 1
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := &tokenBucket{rate: rate, burst: math.Max(float64(burst), 1)}
+	b.tokens = b.burst
+	return b
+}
+
+// take takes n tokens and returns zero or returns time until n tokens are
+// available without taking them. Request greater than burst waits full bucket
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	wait := b.delay(n, now)
+	if wait == 0 {
+		b.tokens -= n
+	}
+	return wait
+}
+
+// delay returns time until n tokens are available, tokens are not taken
+func (b *tokenBucket) delay(n float64, now time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	need := math.Min(n, b.burst)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// clientIP returns IP of request from config or from remote address
+func (s *SSE) clientIP(r *http.Request) string {
+	if s.config.ClientIP != nil {
+		return s.config.ClientIP(r)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// identityKey returns key of identity for limit, CID is used if identity is
+// not set or it can not be key of map
+func identityKey(cid, identity interface{}) interface{} {
+	if identity != nil && reflect.TypeOf(identity).Comparable() {
+		return identity
+	}
+	return cid
+}
+
+// admit checks limits of connections and rate of connecting, counts
+// connection and returns function to release it. Wait close MUST BE locked
+func (s *SSE) admit(cid, identity interface{}, r *http.Request) (func(), *Rejection) {
+	if s.waitClose.denyConnections {
+		return nil, &Rejection{Reason: RejectShutdown, Code: http.StatusServiceUnavailable, RetryAfter: s.retryAfter()}
+	}
+	ip, key := s.clientIP(r), identityKey(cid, identity)
+	if s.config.MaxConnections > 0 && s.waitClose.countConnections >= s.config.MaxConnections ||
+		s.config.MaxConnectionsPerIP > 0 && s.waitClose.perIP[ip] >= s.config.MaxConnectionsPerIP ||
+		s.config.MaxConnectionsPerIdentity > 0 && s.waitClose.perIdentity[key] >= s.config.MaxConnectionsPerIdentity {
+		return nil, &Rejection{Reason: RejectFull, Code: http.StatusServiceUnavailable, RetryAfter: s.retryAfter()}
+	}
+	if s.waitClose.connectRate != nil {
+		if wait := s.waitClose.connectRate.take(1, time.Now()); wait > 0 {
+			return nil, &Rejection{Reason: RejectRateLimited, Code: http.StatusServiceUnavailable, RetryAfter: wait}
+		}
+	}
+	s.waitClose.countConnections++
+	s.waitClose.perIP[ip]++
+	s.waitClose.perIdentity[key]++
+	s.waitClose.Add(1)
+	return func() {
+		s.waitClose.Lock()
+		s.waitClose.countConnections--
+		if s.waitClose.perIP[ip]--; s.waitClose.perIP[ip] == 0 {
+			delete(s.waitClose.perIP, ip)
+		}
+		if s.waitClose.perIdentity[key]--; s.waitClose.perIdentity[key] == 0 {
+			delete(s.waitClose.perIdentity, key)
+		}
+		s.waitClose.Unlock()
+		s.waitClose.Done()
+	}, nil
+}
+
+// retryAfter returns time of Retry-After for full or closed side event
+func (s *SSE) retryAfter() time.Duration {
+	if s.config.RetryAfter > 0 {
+		return s.config.RetryAfter
+	}
+	return time.Second
+}
+
+// reject writes rejection by handler or by default
+func (s *SSE) reject(w http.ResponseWriter, r *http.Request, rej *Rejection) {
+	if s.handlerReject != nil {
+		s.handlerReject(w, r, rej)
+		return
+	}
+	writeRejection(w, r, rej)
+}
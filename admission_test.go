@@ -0,0 +1,149 @@
+package sse
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectConsumer connects consumer and waits count of connections
+func connectConsumer(t *testing.T, serveSSE SideEventer, server *httptest.Server, path string, count int) net.Conn {
+	conn, err := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET " + path + " HTTP/1.1\nHost: foo\n\n"))
+	for i := 0; serveSSE.CountConnections() != count; i++ {
+		if i == 100 {
+			t.Fatalf("expect: %d connections\ngot: %d", count, serveSSE.CountConnections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conn
+}
+
+// admitted returns count of connections which are counted by limits
+func admitted(serveSSE SideEventer) int {
+	s := serveSSE.(*SSE)
+	s.waitClose.Lock()
+	defer s.waitClose.Unlock()
+	return s.waitClose.countConnections
+}
+
+// expectRejection checks status and header Retry-After of response
+func expectRejection(t *testing.T, url string, code int, retryAfter string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != code || resp.Header.Get("Retry-After") != retryAfter {
+		t.Errorf("expected: %d, Retry-After %q\ngot: %d, Retry-After %q", code, retryAfter, resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	return string(body)
+}
+
+func TestRejectDuplicate(t *testing.T) {
+	serveSSE := New(&Config{Retry: time.Second * 3})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveSSE.HandlerHTTP(1, w, r)
+	}))
+	defer server.Close()
+	conn := connectConsumer(t, serveSSE, server, "/", 1)
+	defer conn.Close()
+	expectRejection(t, server.URL, http.StatusConflict, "")
+	serveSSE.Close()
+	expectRejection(t, server.URL, http.StatusServiceUnavailable, "1")
+}
+
+func TestConnectionLimits(t *testing.T) {
+	for name, cfg := range map[string]*Config{
+		"global":   {MaxConnections: 2},
+		"ip":       {MaxConnectionsPerIP: 2},
+		"identity": {MaxConnectionsPerIdentity: 2, MultipleConnections: true},
+	} {
+		cfg.Retry = time.Second * 3
+		cfg.RetryAfter = 5 * time.Second
+		cfg.Authenticator = func(r *http.Request) (interface{}, interface{}, error) {
+			cid := r.URL.Query().Get("cid")
+			return cid, "user-" + cid[:1], nil
+		}
+		serveSSE := New(cfg)
+		server := httptest.NewServer(serveSSE)
+		conn1 := connectConsumer(t, serveSSE, server, "/?cid=a1", 1)
+		conn2 := connectConsumer(t, serveSSE, server, "/?cid=a2", 2)
+		expectRejection(t, server.URL+"/?cid=a3", http.StatusServiceUnavailable, "5")
+		if name == "identity" {
+			// Other identity is not limited
+			conn3 := connectConsumer(t, serveSSE, server, "/?cid=b1", 3)
+			conn3.Close()
+		}
+		// Closed connection releases limit
+		conn1.Close()
+		for i := 0; admitted(serveSSE) != 1 && i < 100; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn4 := connectConsumer(t, serveSSE, server, "/?cid=a4", 2)
+		conn2.Close()
+		conn4.Close()
+		serveSSE.Close()
+		server.Close()
+	}
+}
+
+func TestConnectRate(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:       time.Second * 3,
+		ConnectRate: 0.5,
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn := connectConsumer(t, serveSSE, server, "/", 1)
+	defer conn.Close()
+	expectRejection(t, server.URL, http.StatusServiceUnavailable, "2")
+	serveSSE.Close()
+}
+
+func TestHandlerReject(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry: time.Second * 3,
+		Authenticator: func(r *http.Request) (interface{}, interface{}, error) {
+			if r.URL.Query().Get("logout") != "" {
+				return nil, nil, ErrStopReconnect
+			}
+			return 1, nil, nil
+		},
+	})
+	server := httptest.NewServer(serveSSE)
+	defer server.Close()
+	expectRejection(t, server.URL+"/?logout=1", http.StatusNoContent, "")
+	serveSSE.HandlerReject(func(w http.ResponseWriter, r *http.Request, rej *Rejection) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(rej.Code)
+		io.WriteString(w, `{"reason":"`+rej.Reason.String()+`"}`)
+	})
+	conn := connectConsumer(t, serveSSE, server, "/", 1)
+	defer conn.Close()
+	if body := expectRejection(t, server.URL, http.StatusConflict, ""); body != `{"reason":"duplicate"}` {
+		t.Errorf("unexpected body: %s", body)
+	}
+	serveSSE.Close()
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 2)
+	for i, expected := range []time.Duration{0, 0, 500 * time.Millisecond} {
+		if wait := b.take(1, now); wait != expected {
+			t.Errorf("take %d expected: %s\ngot: %s", i, expected, wait)
+		}
+	}
+	if wait := b.take(1, now.Add(500*time.Millisecond)); wait != 0 {
+		t.Errorf("expected: 0\ngot: %s", wait)
+	}
+}
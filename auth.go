@@ -0,0 +1,84 @@
+package sse
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized rejects consumer with status 401
+	ErrUnauthorized = errors.New("sse: unauthorized")
+	// ErrForbidden rejects consumer with status 403
+	ErrForbidden = errors.New("sse: forbidden")
+)
+
+// A Authenticator represents a function which authenticates request and
+// returns CID of consumer and its identity. Error rejects consumer, status is
+// 403 for ErrForbidden, Code for AuthError and 401 for other errors
+type Authenticator func(r *http.Request) (cid interface{}, identity interface{}, err error)
+
+// A AuthError represents a error of authentication with status code
+type AuthError struct {
+	Code int
+	Err  error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// authStatus returns status code of authentication error
+func authStatus(err error) int {
+	var authErr *AuthError
+	switch {
+	case errors.As(err, &authErr):
+		return authErr.Code
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// A Verifier represents a function which checks credential and returns CID
+// and identity of consumer
+type Verifier func(credential string) (cid interface{}, identity interface{}, err error)
+
+// AuthBearer authenticates by token from header Authorization: Bearer
+func AuthBearer(verify Verifier) Authenticator {
+	return func(r *http.Request) (interface{}, interface{}, error) {
+		const prefix = "bearer "
+		header := r.Header.Get("Authorization")
+		if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+			return nil, nil, ErrUnauthorized
+		}
+		return verify(strings.TrimSpace(header[len(prefix):]))
+	}
+}
+
+// AuthCookie authenticates by value of cookie with name
+func AuthCookie(name string, verify Verifier) Authenticator {
+	return func(r *http.Request) (interface{}, interface{}, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return nil, nil, ErrUnauthorized
+		}
+		return verify(cookie.Value)
+	}
+}
+
+// AuthTLS authenticates by client certificate of TLS connection, certificate
+// has to be verified by server with tls.RequireAndVerifyClientCert
+func AuthTLS(verify func(*x509.Certificate) (cid interface{}, identity interface{}, err error)) Authenticator {
+	return func(r *http.Request) (interface{}, interface{}, error) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return nil, nil, ErrUnauthorized
+		}
+		return verify(r.TLS.PeerCertificates[0])
+	}
+}
@@ -0,0 +1,183 @@
+package sse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// verifyToken accepts token "alice" and forbids token "bob"
+func verifyToken(token string) (interface{}, interface{}, error) {
+	switch token {
+	case "alice":
+		return "cid-alice", "identity-alice", nil
+	case "bob":
+		return nil, nil, ErrForbidden
+	}
+	return nil, nil, ErrUnauthorized
+}
+
+// expectConnection connects client and checks notification about connection
+func expectConnection(t *testing.T, serveSSE SideEventer, client *http.Client, req *http.Request, connections chan *Connection) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected: 200\ngot: %d", resp.StatusCode)
+		}
+	}()
+	select {
+	case conn := <-connections:
+		if conn.CID != "cid-alice" || conn.Identity != "identity-alice" || !conn.Connected {
+			t.Errorf("unexpected connection: %+v", conn)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connect notify was not called")
+	}
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "testMessage"}})
+	<-done
+	select {
+	case conn := <-connections:
+		if conn.Identity != "identity-alice" || conn.Connected {
+			t.Errorf("unexpected disconnection: %+v", conn)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnect notify was not called")
+	}
+}
+
+func TestAuthBearer(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:         time.Second * 3,
+		Authenticator: AuthBearer(verifyToken),
+	})
+	connections := make(chan *Connection, 2)
+	serveSSE.HandlerConnectionNotify(func(conn *Connection) {
+		connections <- conn
+	})
+	reconnect := make(chan *Reconnect, 1)
+	serveSSE.HandlerReconnectNotify(func(rec *Reconnect) {
+		rec.StopRecovery()
+		reconnect <- rec
+	})
+	server := httptest.NewServer(serveSSE)
+	defer server.Close()
+	for token, code := range map[string]int{
+		"":            http.StatusUnauthorized,
+		"Bearer eve":  http.StatusUnauthorized,
+		"Bearer bob":  http.StatusForbidden,
+		"Basic alice": http.StatusUnauthorized,
+	} {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Authorization", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("%q expected: %d\ngot: %d", token, code, resp.StatusCode)
+		}
+	}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	req.Header.Set("Last-Event-ID", "1")
+	client := &http.Client{Timeout: time.Second}
+	expectConnection(t, serveSSE, client, req, connections)
+	select {
+	case rec := <-reconnect:
+		if rec.Identity != "identity-alice" {
+			t.Errorf("expected: identity-alice\ngot: %v", rec.Identity)
+		}
+	default:
+		t.Error("reconnect notify was not called")
+	}
+	serveSSE.Close()
+}
+
+func TestAuthCookie(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:         time.Second * 3,
+		Authenticator: AuthCookie("session", verifyToken),
+	})
+	connections := make(chan *Connection, 2)
+	serveSSE.HandlerConnectionNotify(func(conn *Connection) {
+		connections <- conn
+	})
+	server := httptest.NewServer(serveSSE)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected: 401\ngot: %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "alice"})
+	expectConnection(t, serveSSE, &http.Client{Timeout: time.Second}, req, connections)
+	serveSSE.Close()
+}
+
+func TestAuthTLS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveSSE := New(&Config{
+		Retry: time.Second * 3,
+		Authenticator: AuthTLS(func(cert *x509.Certificate) (interface{}, interface{}, error) {
+			return verifyToken(cert.Subject.CommonName)
+		}),
+	})
+	connections := make(chan *Connection, 2)
+	serveSSE.HandlerConnectionNotify(func(conn *Connection) {
+		connections <- conn
+	})
+	server := httptest.NewUnstartedServer(serveSSE)
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+	// Client without certificate
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected: 401\ngot: %d", resp.StatusCode)
+	}
+	// New transport does not reuse connection without certificate
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}}
+	client := &http.Client{Transport: transport, Timeout: time.Second}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	expectConnection(t, serveSSE, client, req, connections)
+	serveSSE.Close()
+}
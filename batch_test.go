@@ -0,0 +1,217 @@
+package sse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A flushWriter represents a writer which saves flushed writings and
+// measures latency of events which data is time of sending
+type flushWriter struct {
+	sync.Mutex
+	header  http.Header
+	buf     bytes.Buffer
+	flushes []string
+	keep    bool
+	events  int
+	latency time.Duration
+}
+
+func (w *flushWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *flushWriter) WriteHeader(int) {}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.buf.Write(b)
+}
+
+func (w *flushWriter) Flush() {
+	w.Lock()
+	defer w.Unlock()
+	now := time.Now().UnixNano()
+	for _, line := range strings.Split(w.buf.String(), "\n") {
+		if sent, err := strconv.ParseInt(strings.TrimPrefix(line, "data:"), 10, 64); err == nil {
+			w.events++
+			w.latency += time.Duration(now - sent)
+		}
+	}
+	if w.keep {
+		w.flushes = append(w.flushes, w.buf.String())
+	} else {
+		w.flushes = append(w.flushes, "")
+	}
+	w.buf.Reset()
+}
+
+func (w *flushWriter) written() []string {
+	w.Lock()
+	defer w.Unlock()
+	return append([]string(nil), w.flushes...)
+}
+
+func newBatchConsumer(w *flushWriter, latency time.Duration, bytes int) *consumer {
+	cons := newConsumer(&configConsumer{
+		w:            w,
+		retry:        time.Second,
+		metrics:      nopMetrics{},
+		batchLatency: latency,
+		batchBytes:   bytes,
+		queueSize:    50,
+	})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), consumerKey, 1))
+	cons.context, cons.cancelContext = ctx, cancel
+	cons.closeRecovery()
+	return cons
+}
+
+func TestBatchQueued(t *testing.T) {
+	w := &flushWriter{header: make(http.Header), keep: true}
+	cons := newBatchConsumer(w, 0, 1<<10)
+	for count := 1; count <= 10; count++ {
+		cons.send(newFrame(fmt.Sprintf("data:e%d\n\n", count)))
+	}
+	cons.mainQueue.close()
+	cons.serve()
+	flushes := w.written()
+	// The first flush is preamble
+	if len(flushes) != 2 || flushes[0] != "retry:1000\n\n" || strings.Count(flushes[1], "data:") != 10 {
+		t.Errorf("expected: 1 flush with 10 events\ngot: %q", flushes)
+	}
+}
+
+func TestBatchBytes(t *testing.T) {
+	w := &flushWriter{header: make(http.Header), keep: true}
+	cons := newBatchConsumer(w, 0, 20)
+	for count := 1; count <= 10; count++ {
+		cons.send(newFrame(fmt.Sprintf("data:e%d\n\n", count)))
+	}
+	cons.mainQueue.close()
+	cons.serve()
+	flushes := w.written()
+	if len(flushes) != 5 {
+		t.Errorf("expected: 4 flushes after preamble\ngot: %q", flushes)
+	}
+	if events := strings.Count(strings.Join(flushes, ""), "data:"); events != 10 {
+		t.Errorf("expected: 10 events\ngot: %d", events)
+	}
+}
+
+func TestBatchLatency(t *testing.T) {
+	w := &flushWriter{header: make(http.Header), keep: true}
+	cons := newBatchConsumer(w, 100*time.Millisecond, 1<<10)
+	go cons.serve()
+	cons.send(newFrame("data:e1\n\n"))
+	time.Sleep(20 * time.Millisecond)
+	cons.send(newFrame("data:e2\n\n"))
+	time.Sleep(200 * time.Millisecond)
+	flushes := w.written()
+	if len(flushes) != 2 || flushes[1] != "data:e1\n\ndata:e2\n\n" {
+		t.Errorf("expected: 1 flush with 2 events\ngot: %q", flushes)
+	}
+	cons.send(newFrame("data:e3\n\n"))
+	cons.mainQueue.close()
+	<-cons.done
+	if flushes = w.written(); len(flushes) != 3 || flushes[2] != "data:e3\n\n" {
+		t.Errorf("expected: event after closing\ngot: %q", flushes)
+	}
+}
+
+func TestBatchCompression(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:        time.Second * 3,
+		Compression:  true,
+		BatchLatency: 10 * time.Millisecond,
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		for count := 1; count <= 20; count++ {
+			serveSSE.SendEvent(&Event{Data: &DataEvent{Value: strconv.Itoa(count)}})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serveSSE.Shutdown(ctx)
+	}()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for count := 1; count <= 20; count++ {
+		if !bytes.Contains(data, []byte(fmt.Sprintf("data:%d\n", count))) {
+			t.Fatalf("expected event %d\ngot:\n%s", count, data)
+		}
+	}
+}
+
+func BenchmarkBatch(b *testing.B) {
+	for _, consumers := range []int{1, 10, 100} {
+		for _, mode := range []struct {
+			name    string
+			latency time.Duration
+			bytes   int
+		}{
+			{"off", 0, 0},
+			{"queued", 0, 64 << 10},
+			{"latency=1ms", time.Millisecond, 64 << 10},
+		} {
+			b.Run(fmt.Sprintf("consumers=%d/%s", consumers, mode.name), func(b *testing.B) {
+				writers := make([]*flushWriter, consumers)
+				conses := make([]*consumer, consumers)
+				for i := range conses {
+					writers[i] = &flushWriter{header: make(http.Header)}
+					conses[i] = newBatchConsumer(writers[i], mode.latency, mode.bytes)
+					go conses[i].serve()
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					msg := newFrame(fmt.Sprintf("data:%d\n\n", time.Now().UnixNano()))
+					for _, cons := range conses {
+						cons.send(msg)
+					}
+				}
+				for _, cons := range conses {
+					cons.mainQueue.close()
+					<-cons.done
+				}
+				b.StopTimer()
+				var flushes, events int
+				var latency time.Duration
+				for _, w := range writers {
+					flushes += len(w.flushes)
+					events += w.events
+					latency += w.latency
+				}
+				if events > 0 {
+					b.ReportMetric(float64(flushes)/float64(events), "flushes/event")
+					b.ReportMetric(float64(latency)/float64(events), "latency-ns/event")
+				}
+			})
+		}
+	}
+}
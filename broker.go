@@ -0,0 +1,144 @@
+package sse
+
+import (
+	"sync"
+	"time"
+)
+
+// A Broker represents a transport of events between side events, so consumers
+// connected to different servers get the same events. Publish sends message to
+// all subscribers including side event which published it. Subscribe
+// registers handler of messages and returns function to remove it
+type Broker interface {
+	Publish(*Message) error
+	Subscribe(func(*Message)) (unsubscribe func())
+}
+
+// A MessageKind represents a type of event which is transferred by broker
+type MessageKind int
+
+const (
+	// MessageEvent is Event sent to all consumers
+	MessageEvent MessageKind = iota
+	// MessageOnly is EventOnly sent to consumers with CID
+	MessageOnly
+	// MessageExcept is EventExcept sent to consumers except CID
+	MessageExcept
+	// MessageStream is EventStream sent to consumers of stream
+	MessageStream
+	// MessageRetry is EventRetry
+	MessageRetry
+	// MessageSelector is EventSelector sent to consumers matched by selector
+	MessageSelector
+	// MessageComment is EventComment
+	MessageComment
+)
+
+// A Message represents a event which is transferred by broker. CID is used by
+// MessageOnly, MessageExcept and MessageComment, Retry is time of EventRetry or
+// retry sent with event, Comment and Except are used by MessageComment, TTL
+// of event is counted from dispatching by every side event, Key is key of
+// conflation. Custom
+// types of CID have to be registered by
+// gob.Register for TCPBroker
+type Message struct {
+	Kind     MessageKind
+	Event    string
+	Data     DataEvent
+	ID       string
+	CID      []interface{}
+	Stream   string
+	Selector string
+	Retry    time.Duration
+	Comment  string
+	Except   bool
+	TTL      time.Duration
+	Key      string
+}
+
+// newMessage creates message of event, returns false if event is not
+// transferred by broker
+func newMessage(event eventer) (*Message, bool) {
+	switch e := event.(type) {
+	case *Event:
+		return &Message{Kind: MessageEvent, Event: e.Event, Data: *e.Data, ID: e.ID, Retry: e.Retry, TTL: e.TTL, Key: e.Key}, true
+	case *EventOnly:
+		// Connection is known only by own side event
+		if e.ConnID != 0 {
+			return nil, false
+		}
+		return &Message{Kind: MessageOnly, Event: e.Event, Data: *e.Data, ID: e.ID, CID: e.CID, Retry: e.Retry, TTL: e.TTL, Key: e.Key}, true
+	case *EventExcept:
+		return &Message{Kind: MessageExcept, Event: e.Event, Data: *e.Data, ID: e.ID, CID: e.CID, Retry: e.Retry, TTL: e.TTL, Key: e.Key}, true
+	case *EventStream:
+		return &Message{Kind: MessageStream, Event: e.Event, Data: *e.Data, ID: e.ID, Stream: e.Stream, TTL: e.TTL, Key: e.Key}, true
+	case *EventSelector:
+		return &Message{Kind: MessageSelector, Event: e.Event, Data: *e.Data, ID: e.ID, Selector: e.Selector, TTL: e.TTL, Key: e.Key}, true
+	case *EventRetry:
+		return &Message{Kind: MessageRetry, Retry: e.Time}, true
+	case *EventComment:
+		return &Message{Kind: MessageComment, Comment: e.Comment, CID: e.CID, Except: e.Except, Stream: e.Stream, TTL: e.TTL}, true
+	}
+	return nil, false
+}
+
+// eventer creates event of message, returns nil if kind is unknown
+func (m *Message) eventer() eventer {
+	data := m.Data
+	switch m.Kind {
+	case MessageEvent:
+		return &Event{Event: m.Event, Data: &data, ID: m.ID, Retry: m.Retry, TTL: m.TTL, Key: m.Key}
+	case MessageOnly:
+		return &EventOnly{Event: m.Event, Data: &data, ID: m.ID, CID: m.CID, Retry: m.Retry, TTL: m.TTL, Key: m.Key}
+	case MessageExcept:
+		return &EventExcept{Event: m.Event, Data: &data, ID: m.ID, CID: m.CID, Retry: m.Retry, TTL: m.TTL, Key: m.Key}
+	case MessageStream:
+		return &EventStream{Event: m.Event, Data: &data, ID: m.ID, Stream: m.Stream, TTL: m.TTL, Key: m.Key}
+	case MessageSelector:
+		return &EventSelector{Event: m.Event, Data: &data, ID: m.ID, Selector: m.Selector, TTL: m.TTL, Key: m.Key}
+	case MessageRetry:
+		return &EventRetry{Time: m.Retry}
+	case MessageComment:
+		return &EventComment{Comment: m.Comment, CID: m.CID, Except: m.Except, Stream: m.Stream, TTL: m.TTL}
+	}
+	return nil
+}
+
+// A MemoryBroker represents a broker of side events in one process. Messages
+// are delivered to all subscribers in the same order
+type MemoryBroker struct {
+	mx          sync.Mutex
+	subscribers map[int]func(*Message)
+	next        int
+}
+
+// NewMemoryBroker creates broker in memory
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subscribers: make(map[int]func(*Message)),
+	}
+}
+
+// Publish sends message to all subscribers
+func (b *MemoryBroker) Publish(msg *Message) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	for _, handler := range b.subscribers {
+		handler(msg)
+	}
+	return nil
+}
+
+// Subscribe registers handler of messages
+func (b *MemoryBroker) Subscribe(handler func(*Message)) func() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = handler
+	return func() {
+		b.mx.Lock()
+		delete(b.subscribers, id)
+		b.mx.Unlock()
+	}
+}
@@ -0,0 +1,234 @@
+package sse
+
+import (
+	"encoding/gob"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpWriteTimeout limits writing message to connection of broker
+const tcpWriteTimeout = 5 * time.Second
+
+// ErrBrokerClosed is returned by closed broker
+var ErrBrokerClosed = errors.New("sse: broker closed")
+
+// A TCPBrokerServer represents a relay of messages between TCPBroker: message
+// received from one connection is sent to all connections including sender
+type TCPBrokerServer struct {
+	listener net.Listener
+	mx       sync.Mutex
+	conns    map[net.Conn]*gob.Encoder
+}
+
+// ListenTCPBroker listens address and starts relay of messages
+func ListenTCPBroker(addr string) (*TCPBrokerServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &TCPBrokerServer{
+		listener: l,
+		conns:    make(map[net.Conn]*gob.Encoder),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns address of listener
+func (s *TCPBrokerServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops listener and closes all connections
+func (s *TCPBrokerServer) Close() error {
+	err := s.listener.Close()
+	s.mx.Lock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	s.mx.Unlock()
+	return err
+}
+
+// serve accepts connections, connection is registered before reading, so it
+// gets own messages
+func (s *TCPBrokerServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mx.Lock()
+		s.conns[conn] = gob.NewEncoder(conn)
+		s.mx.Unlock()
+		go s.relay(conn)
+	}
+}
+
+// relay reads messages from connection and sends them to all connections
+func (s *TCPBrokerServer) relay(conn net.Conn) {
+	defer s.drop(conn)
+	dec := gob.NewDecoder(conn)
+	for {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		s.mx.Lock()
+		for c, enc := range s.conns {
+			c.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+			if err := enc.Encode(&msg); err != nil {
+				c.Close()
+				delete(s.conns, c)
+			}
+		}
+		s.mx.Unlock()
+	}
+}
+
+// drop closes connection and removes it
+func (s *TCPBrokerServer) drop(conn net.Conn) {
+	s.mx.Lock()
+	delete(s.conns, conn)
+	s.mx.Unlock()
+	conn.Close()
+}
+
+// A TCPBroker represents a broker which transfers messages through
+// TCPBrokerServer. Broken connection is restored in background, messages sent
+// while connection is broken are lost
+type TCPBroker struct {
+	addr string
+	mx   sync.Mutex
+	conn net.Conn
+	enc  *gob.Encoder
+	// Subscribers are called from one goroutine in order of messages
+	subscribers struct {
+		sync.RWMutex
+		value map[int]func(*Message)
+		next  int
+	}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// DialTCPBroker connects to TCPBrokerServer
+func DialTCPBroker(addr string) (*TCPBroker, error) {
+	b := &TCPBroker{
+		addr:   addr,
+		closed: make(chan struct{}),
+	}
+	b.subscribers.value = make(map[int]func(*Message))
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	go b.receive(conn)
+	return b, nil
+}
+
+// Publish sends message to server
+func (b *TCPBroker) Publish(msg *Message) error {
+	if _, err := b.connect(); err != nil {
+		return err
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.conn == nil {
+		return ErrBrokerClosed
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	if err := b.enc.Encode(msg); err != nil {
+		b.conn.Close()
+		b.conn, b.enc = nil, nil
+		return err
+	}
+	return nil
+}
+
+// Subscribe registers handler of messages
+func (b *TCPBroker) Subscribe(handler func(*Message)) func() {
+	b.subscribers.Lock()
+	defer b.subscribers.Unlock()
+	id := b.subscribers.next
+	b.subscribers.next++
+	b.subscribers.value[id] = handler
+	return func() {
+		b.subscribers.Lock()
+		delete(b.subscribers.value, id)
+		b.subscribers.Unlock()
+	}
+}
+
+// Close closes connection and stops restoring it
+func (b *TCPBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn, b.enc = nil, nil
+	}
+	return nil
+}
+
+// connect returns current connection or dials new one
+func (b *TCPBroker) connect() (net.Conn, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	select {
+	case <-b.closed:
+		return nil, ErrBrokerClosed
+	default:
+	}
+	if b.conn != nil {
+		return b.conn, nil
+	}
+	conn, err := net.Dial("tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	b.conn, b.enc = conn, gob.NewEncoder(conn)
+	return conn, nil
+}
+
+// receive reads messages and calls subscribers. Broken connection is dialed
+// again until broker is closed
+func (b *TCPBroker) receive(conn net.Conn) {
+	for {
+		dec := gob.NewDecoder(conn)
+		for {
+			var msg Message
+			if err := dec.Decode(&msg); err != nil {
+				break
+			}
+			b.subscribers.RLock()
+			for _, handler := range b.subscribers.value {
+				handler(&msg)
+			}
+			b.subscribers.RUnlock()
+		}
+		b.mx.Lock()
+		if b.conn == conn {
+			conn.Close()
+			b.conn, b.enc = nil, nil
+		}
+		b.mx.Unlock()
+		for {
+			select {
+			case <-b.closed:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			var err error
+			if conn, err = b.connect(); err == nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package sse
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokerNode starts side event with broker and connects consumer with cid
+func brokerNode(t *testing.T, broker Broker, cid string) (SideEventer, *httptest.Server, net.Conn) {
+	serveSSE := New(&Config{
+		Retry:      time.Second * 3,
+		ReplaySize: 10,
+		Broker:     broker,
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveSSE.HandlerHTTP(cid, w, r)
+	}))
+	conn, err := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	return serveSSE, server, conn
+}
+
+// readUntil reads connection until response contains expecting
+func readUntil(t *testing.T, c net.Conn, expecting string) string {
+	var resp []byte
+	buf := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	for !strings.Contains(string(resp), expecting) {
+		n, err := c.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if err != nil {
+			t.Errorf("expected:\n%s\ngot:\n%s\n", expecting, resp)
+			break
+		}
+	}
+	return string(resp)
+}
+
+func testBroker(t *testing.T, brokerA, brokerB Broker) {
+	serveA, serverA, connA := brokerNode(t, brokerA, "a")
+	defer serverA.Close()
+	defer connA.Close()
+	serveB, serverB, connB := brokerNode(t, brokerB, "b")
+	defer serverB.Close()
+	defer connB.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	serveA.SendEvent(&EventOnly{
+		CID:   []interface{}{"b"},
+		Data:  &DataEvent{Value: "onlyB"},
+		ID:    "1",
+		Retry: time.Second * 5,
+	})
+	serveB.SendEvent(&EventExcept{
+		CID:  []interface{}{"b"},
+		Data: &DataEvent{Value: "exceptB"},
+		ID:   "2",
+	})
+	serveB.SendEvent(&EventComment{
+		Comment: "onlyA",
+		CID:     []interface{}{"a"},
+	})
+	serveB.SendEvent(&Event{
+		Data: &DataEvent{Value: "all"},
+		ID:   "3",
+	})
+	respA := readUntil(t, connA, "data:all\nid:3\n")
+	respB := readUntil(t, connB, "data:all\nid:3\n")
+	if !strings.Contains(respA, "data:exceptB\nid:2\n") || !strings.Contains(respA, ": onlyA\n") || strings.Contains(respA, "onlyB") {
+		t.Errorf("unexpected events of consumer a:\n%s", respA)
+	}
+	if !strings.Contains(respB, "data:onlyB\nid:1\nretry:5000\n") || strings.Contains(respB, "exceptB") || strings.Contains(respB, "onlyA") {
+		t.Errorf("unexpected events of consumer b:\n%s", respB)
+	}
+	serveA.Close()
+	serveB.Close()
+}
+
+func TestMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	testBroker(t, broker, broker)
+}
+
+func TestTCPBroker(t *testing.T) {
+	server, err := ListenTCPBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	brokerA, err := DialTCPBroker(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer brokerA.Close()
+	brokerB, err := DialTCPBroker(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer brokerB.Close()
+	testBroker(t, brokerA, brokerB)
+}
+
+func TestBrokerReplay(t *testing.T) {
+	broker := NewMemoryBroker()
+	serveA := New(&Config{Retry: time.Second * 3, Broker: broker})
+	serveB := New(&Config{Retry: time.Second * 3, ReplaySize: 10, Broker: broker})
+	for _, id := range []string{"1", "2"} {
+		serveA.SendEvent(&Event{
+			Data: &DataEvent{Value: "testMessage" + id},
+			ID:   id,
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+	// Consumer reconnected to other server gets lost events with the same ID
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveB.HandlerHTTP("b", w, r)
+	}))
+	defer server.Close()
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\nLast-Event-ID: 1\n\n"))
+	readUntil(t, conn, "data:testMessage2\nid:2\n")
+	serveA.Close()
+	serveB.Close()
+}
@@ -5,28 +5,69 @@
 package sse
 
 import (
-	"bufio"
-	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"mime"
 	"net/http"
 	"strings"
-
+	"sync"
+	"time"
 )
 
-var (
-	headerID    = []byte("id:")
-	headerData  = []byte("data:")
-	headerEvent = []byte("event:")
-	headerError = []byte("error:")
+// defaultRetry is reconnection time, if Retry of client is not set
+const defaultRetry = 3 * time.Second
+
+// ErrNoContent is returned when server responded with status 204, it means
+// that client must not reconnect
+var ErrNoContent = errors.New("sse: server responded with no content")
+
+// A ConnState represents a state of client connection
+type ConnState int
+
+const (
+	// StateConnecting means that client connects or reconnects to server
+	StateConnecting ConnState = iota
+	// StateOpen means that connection is established
+	StateOpen
+	// StateClosed means that client stopped reconnecting
+	StateClosed
 )
 
-// Client handles an incoming server stream
+// Client handles an incoming server stream. Client reconnects automatically
+// after losing connection: Retry is reconnection time, which server can change
+// with field retry, delay is doubled for every failed attempt up to MaxBackoff,
+// MaxRetries limits count failed attempts in a row (zero means no limit),
+// connection which delivered no events is failed attempt too. LastEventID is
+// initial value of header Last-Event-ID, every subscription tracks last event
+// ID itself. Clock is source of time for reconnection, default is system time
 type Client struct {
-	URL            string
-	Connection     *http.Client
-	Headers        map[string]string
-	EncodingBase64 bool
+	URL                string
+	Connection         *http.Client
+	Headers            map[string]string
+	EncodingBase64     bool
+	Retry              time.Duration
+	MaxBackoff         time.Duration
+	MaxRetries         int
+	LastEventID        string
+	Clock              Clock
+	handlerStateNotify func(ConnState)
+	handlerErrorNotify func(error)
+	listeners          struct {
+		sync.RWMutex
+		value map[string][]*listener
+	}
+}
+
+// A listener represents a handler of events with selected name
+type listener struct {
+	handler func(*Event)
 }
 
 // NewClient creates a new client
@@ -35,101 +76,210 @@ func NewClient(url string) *Client {
 		URL:        url,
 		Connection: &http.Client{},
 		Headers:    make(map[string]string),
+		Retry:      defaultRetry,
+		MaxBackoff: 30 * time.Second,
 	}
 }
 
-// Subscribe to a data stream
+// HandlerStateNotify calls function, when state of connection is changed
+func (c *Client) HandlerStateNotify(handler func(ConnState)) {
+	c.handlerStateNotify = handler
+}
+
+// Subscribe to a data stream, handler gets data of every event
 func (c *Client) Subscribe(stream string, handler func(msg []byte)) error {
-	resp, err := c.request(stream)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+	return c.SubscribeWithContext(context.Background(), stream, handler)
+}
 
-	reader := bufio.NewReader(resp.Body)
+// SubscribeWithContext subscribes to a data stream until context is done,
+// handler gets data of every event
+func (c *Client) SubscribeWithContext(ctx context.Context, stream string, handler func(msg []byte)) error {
+	return c.SubscribeEventWithContext(ctx, stream, func(msg *Event) {
+		handler([]byte(msg.Data.Value))
+	})
+}
 
-	for {
-		// Read each new line and process the type of event
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			return err
+// SubscribeEvent subscribes to a data stream, handler gets every event
+func (c *Client) SubscribeEvent(stream string, handler func(msg *Event)) error {
+	return c.SubscribeEventWithContext(context.Background(), stream, handler)
+}
 
+// SubscribeEventWithContext subscribes to a data stream until context is
+// done, handler gets every event. It returns error of context after cancel
+func (c *Client) SubscribeEventWithContext(ctx context.Context, stream string, handler func(msg *Event)) error {
+	retry := c.Retry
+	if retry <= 0 {
+		retry = defaultRetry
+	}
+	lastEventID := c.LastEventID
+	for attempt := 1; ; attempt++ {
+		c.notifyState(StateConnecting)
+		resp, err := c.request(ctx, stream, lastEventID)
+		if err == nil {
+			err = c.checkResponse(resp)
+			if err != nil {
+				resp.Body.Close()
+				c.notifyError(err)
+				c.notifyState(StateClosed)
+				return err
+			}
+			c.notifyState(StateOpen)
+			dec := NewDecoder(newDecompressor(resp))
+			dec.setLastEventID(lastEventID)
+			var delivered bool
+			delivered, err = c.read(dec, handler)
+			lastEventID = dec.LastEventID()
+			resp.Body.Close()
+			// Backoff is reset only if stream worked
+			if delivered {
+				attempt = 1
+			}
+			if dec.Retry() > 0 {
+				retry = dec.Retry()
+			}
 		}
-
-		if len(line)>1 {
-			handler(line)
+		if ctx.Err() != nil {
+			c.notifyState(StateClosed)
+			return ctx.Err()
+		}
+		c.notifyError(err)
+		if c.MaxRetries > 0 && attempt > c.MaxRetries {
+			c.notifyState(StateClosed)
+			return err
+		}
+		timer := clockOr(c.Clock).NewTimer(c.backoff(retry, attempt))
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			c.notifyState(StateClosed)
+			return ctx.Err()
 		}
-
-		//msg := c.processEvent(line)
-		//if msg != nil {
-		//	handler(msg)
-		//}
 	}
 }
 
-// Subscribe to a data stream
-func (c *Client) SubscribeEvent(stream string, handler func(msg *Event)) error {
-	resp, err := c.request(stream)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// SubscribeChan sends data of all events to the provided channel
+func (c *Client) SubscribeChan(stream string, ch chan []byte) error {
+	return c.SubscribeChanWithContext(context.Background(), stream, ch)
+}
 
-	reader := bufio.NewReader(resp.Body)
-	msg := &Event{
+// SubscribeChanWithContext sends data of all events to the provided channel
+// until context is done. Channel is closed when function returns
+func (c *Client) SubscribeChanWithContext(ctx context.Context, stream string, ch chan []byte) error {
+	defer close(ch)
+	return c.SubscribeEventWithContext(ctx, stream, func(msg *Event) {
+		select {
+		case ch <- []byte(msg.Data.Value):
+		case <-ctx.Done():
+		}
+	})
+}
 
-		Data:&DataEvent{},
-	}
+// read reads events from stream until error of reading, delivered is true
+// if at least one event was read
+func (c *Client) read(dec *Decoder, handler func(msg *Event)) (delivered bool, err error) {
 	for {
-		// Read each new line and process the type of event
-		line, err := reader.ReadBytes('\n')
-		//fmt.Println("line:",string(line),len(line))
+		msg, err := dec.Decode()
 		if err != nil {
-			return err
+			return delivered, err
 		}
-		if len(strings.TrimSpace(string(line)))==0 {
-			//fmt.Println("eeerrr:")
-			handler(msg)
+		delivered = true
+		c.decodeData(msg)
+		handler(msg)
+	}
+}
 
-			msg = &Event{
-				Data:&DataEvent{},
-			}
-		}
+// checkResponse checks that server responded with event stream. Client must
+// not reconnect if it is not
+func (c *Client) checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNoContent {
+		return ErrNoContent
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sse: unexpected status %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		return fmt.Errorf("sse: unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	return nil
+}
 
-		c.processEvent(line,msg)
+// backoff returns delay before reconnecting: retry is doubled for every
+// failed attempt, limited by MaxBackoff and randomized by jitter
+func (c *Client) backoff(retry time.Duration, attempt int) time.Duration {
+	delay := retry
+	for i := 1; i < attempt && (c.MaxBackoff <= 0 || delay < c.MaxBackoff); i++ {
+		delay *= 2
 	}
+	if c.MaxBackoff > 0 && delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+	// Jitter spreads reconnections of many clients
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
 
+// HandlerErrorNotify calls function, when connection is failed or lost
+func (c *Client) HandlerErrorNotify(handler func(error)) {
+	c.handlerErrorNotify = handler
 }
 
-// SubscribeChan sends all events to the provided channel
-func (c *Client) SubscribeChan(stream string, ch chan []byte) error {
-	resp, err := c.request(stream)
-	if err != nil {
-		return err
+// notifyError sends notification about error of connection
+func (c *Client) notifyError(err error) {
+	if c.handlerErrorNotify != nil && err != nil {
+		c.handlerErrorNotify(err)
 	}
-	defer resp.Body.Close()
+}
 
-	reader := bufio.NewReader(resp.Body)
+// AddEventListener registers handler for events with name, like
+// addEventListener of browser EventSource. Events without name have name
+// "message". Returned function removes handler. Handlers get the same event
+// and must not modify it
+func (c *Client) AddEventListener(event string, handler func(*Event)) (remove func()) {
+	l := &listener{handler: handler}
+	c.listeners.Lock()
+	if c.listeners.value == nil {
+		c.listeners.value = make(map[string][]*listener)
+	}
+	c.listeners.value[event] = append(c.listeners.value[event], l)
+	c.listeners.Unlock()
+	return func() {
+		c.listeners.Lock()
+		defer c.listeners.Unlock()
+		listeners := c.listeners.value[event]
+		for i := range listeners {
+			if listeners[i] == l {
+				c.listeners.value[event] = append(listeners[:i:i], listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
 
+// Listen subscribes to a data stream until context is done and sends every
+// event to listeners registered for its name
+func (c *Client) Listen(ctx context.Context, stream string) error {
+	return c.SubscribeEventWithContext(ctx, stream, c.dispatch)
+}
 
-	for {
-		// Read each new line and process the type of event
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			close(ch)
-			return err
-		}
-		ch <- line
+// dispatch sends event to listeners
+func (c *Client) dispatch(msg *Event) {
+	c.listeners.RLock()
+	listeners := c.listeners.value[msg.Event]
+	c.listeners.RUnlock()
+	for _, l := range listeners {
+		l.handler(msg)
+	}
+}
 
-		//msg := c.processEvent(line)
-		//if msg != nil {
-		//	ch <- msg
-		//}
+// notifyState sends notification about state of connection
+func (c *Client) notifyState(state ConnState) {
+	if c.handlerStateNotify != nil {
+		c.handlerStateNotify(state)
 	}
 }
 
-func (c *Client) request(stream string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", c.URL, nil)
+func (c *Client) request(ctx context.Context, stream, lastEventID string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.URL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -142,6 +292,10 @@ func (c *Client) request(stream string) (*http.Response, error) {
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Accept", "text/event-stream")
 	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
 
 	// Add user specified headers
 	for k, v := range c.Headers {
@@ -151,81 +305,49 @@ func (c *Client) request(stream string) (*http.Response, error) {
 	return c.Connection.Do(req)
 }
 
-func (c *Client) processEvent(msg []byte,e *Event)  {
+// A decompressor represents a reader of body which decompresses it by
+// Content-Encoding. Reader of encoding is created on first reading, because
+// it reads header of stream
+type decompressor struct {
+	body     io.Reader
+	encoding string
+	r        io.Reader
+}
 
+// newDecompressor creates reader of response body
+func newDecompressor(resp *http.Response) io.Reader {
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if encoding != "gzip" && encoding != "deflate" {
+		return resp.Body
+	}
+	return &decompressor{body: resp.Body, encoding: encoding}
+}
 
-	switch h := msg; {
-	case bytes.Contains(h, headerID):
-		e.ID = string(trimHeader(len(headerID), msg))
-	case bytes.Contains(h, headerData):
-		e.Data = &DataEvent{
-			Value:string(trimHeader(len(headerData), msg)),
-			DisabledFormatting:false,
+func (d *decompressor) Read(p []byte) (int, error) {
+	if d.r == nil {
+		var err error
+		if d.encoding == "gzip" {
+			d.r, err = gzip.NewReader(d.body)
+		} else {
+			d.r, err = zlib.NewReader(d.body)
+		}
+		if err != nil {
+			return 0, err
 		}
-	case bytes.Contains(h, headerEvent):
-		e.Event = string(trimHeader(len(headerEvent), msg))
-	case bytes.Contains(h, headerError):
-		e.Error = string(trimHeader(len(headerError), msg))
-	default:
-		return
 	}
+	return d.r.Read(p)
+}
 
-
+// decodeData decodes data of event, if data is encoded to base64
+func (c *Client) decodeData(e *Event) {
 	if len(e.Data.Value) > 0 && c.EncodingBase64 {
 		buf := make([]byte, base64.StdEncoding.DecodedLen(len(e.Data.Value)))
 
-		_, err := base64.StdEncoding.Decode(buf, []byte(e.Data.Value))
+		n, err := base64.StdEncoding.Decode(buf, []byte(e.Data.Value))
 		if err != nil {
 			log.Println(err)
 		}
 
-		e.Data.Value = string(buf)
-	}
-
-	return
-}
-
-//
-//func (c *Client) processEvent(msg []byte) *Event {
-//	var e Event
-//
-//	switch h := msg; {
-//	case bytes.Contains(h, headerID):
-//		e.ID = string(trimHeader(len(headerID), msg))
-//	case bytes.Contains(h, headerData):
-//		e.Data =
-//			trimHeader(len(headerData), msg)
-//	case bytes.Contains(h, headerEvent):
-//		e.Event = string(trimHeader(len(headerEvent), msg))
-//	case bytes.Contains(h, headerError):
-//		e.Error = string(trimHeader(len(headerError), msg))
-//	default:
-//		return nil
-//	}
-//
-//	if len(e.Data) > 0 && c.EncodingBase64 {
-//		buf := make([]byte, base64.StdEncoding.DecodedLen(len(e.Data)))
-//
-//		_, err := base64.StdEncoding.Decode(buf, e.Data)
-//		if err != nil {
-//			log.Println(err)
-//		}
-//
-//		e.Data = buf
-//	}
-//
-//	return &e
-//}
-
-func trimHeader(size int, data []byte) []byte {
-	data = data[size:]
-	// Remove optional leading whitespace
-	if data[0] == 32 {
-		data = data[1:]
-	}
-	// Remove trailing new line
-	if data[len(data)-1] == 10 {
-		data = data[:len(data)-1]
-	}
-	return data
+		e.Data.Value = string(buf[:n])
+	}
 }
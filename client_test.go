@@ -5,8 +5,12 @@
 package sse
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,24 +21,43 @@ var url string
 
 func setup() {
 	// New Server
-	s := New()
+	s := New(&Config{
+		Retry: time.Second * 3,
+	})
 
+	var cid int64
 	mux := http.NewServeMux()
-	mux.HandleFunc("/events", s.HTTPHandler)
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		s.HandlerHTTP(atomic.AddInt64(&cid, 1), w, r)
+	})
 	server := httptest.NewServer(mux)
 	url = server.URL + "/events"
 
 	s.CreateStream("test")
 
 	// Send continuous string of events to the client
-	go func(s *Server) {
+	go func(s SideEventer) {
 		for {
-			s.Publish("test", []byte("ping"))
+			s.SendEvent(&EventStream{
+				Stream: "test",
+				Data: &DataEvent{
+					Value: "ping",
+				},
+			})
 			time.Sleep(time.Millisecond * 500)
 		}
 	}(s)
 }
 
+func wait(ch chan []byte, duration time.Duration) ([]byte, error) {
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-time.After(duration):
+		return nil, errors.New("timeout")
+	}
+}
+
 func TestClient(t *testing.T) {
 	setup()
 	Convey("Given a new Client", t, func() {
@@ -46,10 +69,7 @@ func TestClient(t *testing.T) {
 				var cErr error
 				go func(cErr error) {
 					cErr = c.Subscribe("test", func(msg []byte) {
-						//if msg.Data != nil {
-						//	events <- msg.Data
-						//	return
-						//}
+						events <- msg
 					})
 				}(cErr)
 
@@ -64,3 +84,175 @@ func TestClient(t *testing.T) {
 		})
 	})
 }
+
+func TestClientReconnect(t *testing.T) {
+	var requests int64
+	lastEventID := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastEventID <- r.Header.Get("Last-Event-ID")
+		switch atomic.AddInt64(&requests, 1) {
+		case 1:
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("retry:10\nid:1\ndata:first\n\n"))
+		case 2:
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data:second\n\n"))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	var states []ConnState
+	c.HandlerStateNotify(func(state ConnState) {
+		states = append(states, state)
+	})
+	var events []string
+	err := c.Subscribe("test", func(msg []byte) {
+		events = append(events, string(msg))
+	})
+	if err != ErrNoContent {
+		t.Errorf("expected: %v\ngot: %v", ErrNoContent, err)
+	}
+	if strings.Join(events, ",") != "first,second" {
+		t.Errorf("expected: first,second\ngot: %v", events)
+	}
+	for _, expect := range []string{"", "1", "1"} {
+		if id := <-lastEventID; id != expect {
+			t.Errorf("expected Last-Event-ID: %q\ngot: %q", expect, id)
+		}
+	}
+	expectStates := []ConnState{StateConnecting, StateOpen, StateConnecting, StateOpen, StateConnecting, StateClosed}
+	if len(states) != len(expectStates) {
+		t.Fatalf("expected: %v\ngot: %v", expectStates, states)
+	}
+	for i := range states {
+		if states[i] != expectStates[i] {
+			t.Fatalf("expected: %v\ngot: %v", expectStates, states)
+		}
+	}
+}
+
+func TestClientMaxRetries(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		hj, _ := w.(http.Hijacker)
+		conn, _, _ := hj.Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	c.Retry = time.Millisecond
+	c.MaxRetries = 2
+	if err := c.Subscribe("test", func(msg []byte) {}); err == nil {
+		t.Error("expected error")
+	}
+	if atomic.LoadInt64(&requests) != 3 {
+		t.Errorf("expected: 3\ngot: %d", atomic.LoadInt64(&requests))
+	}
+}
+
+func TestClientMaxRetriesEmptyStream(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(": ping\n"))
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	c.Retry = time.Millisecond
+	c.MaxRetries = 2
+	if err := c.Subscribe("test", func(msg []byte) {}); err == nil {
+		t.Error("expected error")
+	}
+	if atomic.LoadInt64(&requests) != 3 {
+		t.Errorf("expected: 3\ngot: %d", atomic.LoadInt64(&requests))
+	}
+}
+
+func TestClientSubscribeChanWithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data:first\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.SubscribeChanWithContext(ctx, "test", events)
+	}()
+	msg, err := wait(events, time.Second)
+	if err != nil || string(msg) != "first" {
+		t.Fatalf("expected: first\ngot: %s %v", msg, err)
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("expected: %v\ngot: %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not cancelled")
+	}
+	if _, ok := <-events; ok {
+		t.Error("channel was not closed")
+	}
+}
+
+func TestClientListen(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data:first\n\nevent:price\ndata:1.5\n\nevent:other\ndata:skip\n\n"))
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	c.Retry = time.Millisecond
+	var messages, prices, removed []string
+	c.AddEventListener("message", func(e *Event) {
+		messages = append(messages, e.Data.Value)
+	})
+	c.AddEventListener("price", func(e *Event) {
+		prices = append(prices, e.Data.Value)
+	})
+	remove := c.AddEventListener("price", func(e *Event) {
+		removed = append(removed, e.Data.Value)
+	})
+	// Stream is lost after every connection, listening is stopped after
+	// the second error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var errs int
+	c.HandlerErrorNotify(func(err error) {
+		errs++
+		remove()
+		if errs == 2 {
+			cancel()
+		}
+	})
+	if err := c.Listen(ctx, "test"); err != context.Canceled {
+		t.Errorf("expected: %v\ngot: %v", context.Canceled, err)
+	}
+	if strings.Join(messages, ",") != "first,first" {
+		t.Errorf("expected: first,first\ngot: %v", messages)
+	}
+	if strings.Join(prices, ",") != "1.5,1.5" {
+		t.Errorf("expected: 1.5,1.5\ngot: %v", prices)
+	}
+	if strings.Join(removed, ",") != "1.5" {
+		t.Errorf("expected: 1.5\ngot: %v", removed)
+	}
+	if errs != 2 {
+		t.Errorf("expected: 2\ngot: %d", errs)
+	}
+}
@@ -0,0 +1,46 @@
+package sse
+
+import "time"
+
+// A Clock represents a source of time for heartbeat of consumers and
+// reconnection of client, it can be replaced by fake clock in tests, see
+// package ssetest. Nil Clock means system time
+type Clock interface {
+	Now() time.Time
+	NewTimer(time.Duration) Timer
+}
+
+// A Timer represents a timer created by Clock, it works like time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(time.Duration) bool
+}
+
+// A systemClock represents a clock of system time
+type systemClock struct{}
+
+// A systemTimer represents a timer of system time
+type systemTimer struct {
+	*time.Timer
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// clockOr returns clock or system clock if it is not set
+func clockOr(clock Clock) Clock {
+	if clock == nil {
+		return systemClock{}
+	}
+	return clock
+}
@@ -0,0 +1,98 @@
+package sse
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// A Codec represents a interface of encoding values to data of events.
+// Codec must produce text, binary formats can be wrapped with Base64
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSON is codec which encodes values to JSON
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// A base64Codec represents a codec which encodes output of other codec to base64
+type base64Codec struct {
+	codec Codec
+}
+
+// Base64 returns codec which encodes output of codec to base64. It allows to
+// send binary formats, e.g. msgpack
+func Base64(codec Codec) Codec {
+	return base64Codec{codec: codec}
+}
+
+func (c base64Codec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(buf, data)
+	return buf, nil
+}
+
+func (c base64Codec) Unmarshal(data []byte, v interface{}) error {
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(buf, data)
+	if err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(buf[:n], v)
+}
+
+// NewEvent creates event which data is value encoded by codec, JSON is used
+// if codec is nil. Data is formatted, so multiline output of codec is sent
+// in several fields data and joined by client
+func NewEvent(event string, v interface{}, codec Codec) (*Event, error) {
+	if codec == nil {
+		codec = JSON
+	}
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Event{
+		Event: event,
+		Data: &DataEvent{
+			Value: string(data),
+		},
+	}, nil
+}
+
+// SubscribeAs subscribes client to a data stream and decodes data of events
+// with name event to value of type T, JSON is used if codec is nil. Events
+// without name have name "message". Event which can not be decoded is skipped
+// and error is sent to ErrorNotify of client
+func SubscribeAs[T any](ctx context.Context, c *Client, stream, event string, codec Codec, handler func(T)) error {
+	if codec == nil {
+		codec = JSON
+	}
+	return c.SubscribeEventWithContext(ctx, stream, func(msg *Event) {
+		if msg.Event != event {
+			return
+		}
+		var v T
+		if err := codec.Unmarshal([]byte(msg.Data.Value), &v); err != nil {
+			c.notifyError(fmt.Errorf("sse: decode event %q: %w", msg.Event, err))
+			return
+		}
+		handler(v)
+	})
+}
@@ -0,0 +1,139 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testPrice struct {
+	Symbol string  `json:"symbol"`
+	Price  float64 `json:"price"`
+}
+
+type indentCodec struct{}
+
+func (indentCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+func (indentCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestNewEvent(t *testing.T) {
+	e, err := NewEvent("price", testPrice{Symbol: "ACME", Price: 1.5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"symbol":"ACME","price":1.5}`
+	if e.Event != "price" || e.Data.Value != expect {
+		t.Errorf("expected:\n%s\ngot:\n%s", expect, e.Data.Value)
+	}
+}
+
+func TestSubscribeAs(t *testing.T) {
+	for _, codec := range []Codec{JSON, Base64(JSON), indentCodec{}} {
+		serveSSE := New(&Config{
+			Retry: time.Second * 3,
+		})
+		connected := make(chan interface{}, 1)
+		serveSSE.HandlerConnectNotify(func(cid interface{}) {
+			connected <- cid
+		})
+		server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+		ctx, cancel := context.WithCancel(context.Background())
+		prices := make(chan testPrice, 1)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- SubscribeAs(ctx, NewClient(server.URL), "", "price", codec, func(v testPrice) {
+				prices <- v
+			})
+		}()
+		select {
+		case <-connected:
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("client was not connected")
+		}
+		for _, name := range []string{"other", "price"} {
+			e, _ := NewEvent(name, testPrice{Symbol: name, Price: 1.5}, codec)
+			serveSSE.SendEvent(e)
+		}
+		select {
+		case v := <-prices:
+			if v.Symbol != "price" || v.Price != 1.5 {
+				t.Errorf("expected: price 1.5\ngot: %+v", v)
+			}
+		case <-time.After(time.Second):
+			t.Error("event was not decoded")
+		}
+		cancel()
+		if err := <-errs; err != context.Canceled {
+			t.Errorf("expected: %v\ngot: %v", context.Canceled, err)
+		}
+		serveSSE.Close()
+		server.Close()
+	}
+}
+
+func TestSubscribeAsDecodeError(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry: time.Second * 3,
+	})
+	connected := make(chan interface{}, 1)
+	serveSSE.HandlerConnectNotify(func(cid interface{}) {
+		connected <- cid
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewClient(server.URL)
+	decodeErrs := make(chan error, 1)
+	c.HandlerErrorNotify(func(err error) {
+		select {
+		case decodeErrs <- err:
+		default:
+		}
+	})
+	prices := make(chan testPrice, 1)
+	go SubscribeAs(ctx, c, "", "price", JSON, func(v testPrice) {
+		prices <- v
+	})
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("client was not connected")
+	}
+	serveSSE.SendEvent(&Event{
+		Event: "price",
+		Data: &DataEvent{
+			Value: "{malformed",
+		},
+	})
+	e, _ := NewEvent("price", testPrice{Symbol: "ACME", Price: 1.5}, JSON)
+	serveSSE.SendEvent(e)
+	select {
+	case err := <-decodeErrs:
+		if err == nil {
+			t.Error("expected error of decoding")
+		}
+	case <-time.After(time.Second):
+		t.Error("error of decoding was not notified")
+	}
+	// Subscription continues after error
+	select {
+	case v := <-prices:
+		if v.Symbol != "ACME" {
+			t.Errorf("expected: ACME\ngot: %+v", v)
+		}
+	case <-time.After(time.Second):
+		t.Error("event was not decoded")
+	}
+	serveSSE.Close()
+}
@@ -0,0 +1,150 @@
+package sse
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A frame represents a formatted event which is shared by consumers. Deflated
+// form is created once by the first consumer which needs it, it is an
+// independent block of deflate stream ended by sync flush, so it can be
+// written to any compressed stream. Event is expired if it is older than ttl,
+// zero ttl means default ttl of consumer and negative ttl means no expiry.
+// Queued frame with key is replaced by new frame with the same key
+type frame struct {
+	msg     string
+	created time.Time
+	ttl     time.Duration
+	key     string
+	deflate struct {
+		sync.Once
+		data []byte
+	}
+}
+
+// newFrame creates frame of message
+func newFrame(msg string) *frame {
+	return &frame{msg: msg, created: time.Now()}
+}
+
+// newEventFrame creates frame of event with ttl and key of conflation
+func newEventFrame(msg string, ttl time.Duration, key string) *frame {
+	return &frame{msg: msg, created: time.Now(), ttl: ttl, key: key}
+}
+
+// expired checks that frame is older than its ttl or default ttl
+func (f *frame) expired(now time.Time, ttl time.Duration) bool {
+	if f.ttl != 0 {
+		ttl = f.ttl
+	}
+	return ttl > 0 && now.Sub(f.created) > ttl
+}
+
+// heartbeatFrame is shared comment of heartbeat
+var heartbeatFrame = newFrame(": ping\n")
+
+// flateWriters are reused writers of deflate blocks
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// deflated returns compressed message
+func (f *frame) deflated() []byte {
+	f.deflate.Do(func() {
+		var b bytes.Buffer
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&b)
+		io.WriteString(w, f.msg)
+		w.Flush()
+		flateWriters.Put(w)
+		f.deflate.data = b.Bytes()
+	})
+	return f.deflate.data
+}
+
+// finalBlock is empty final stored block of deflate stream
+var finalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// A compressor represents a compressed stream of consumer: header, shared
+// deflated frames and trailer with checksum of uncompressed data
+type compressor struct {
+	encoding string
+	sum      hash.Hash32
+	size     uint32
+	started  bool
+}
+
+// newCompressor creates compressor of encoding gzip or deflate
+func newCompressor(encoding string) *compressor {
+	c := &compressor{encoding: encoding}
+	if encoding == "gzip" {
+		c.sum = crc32.NewIEEE()
+	} else {
+		c.sum = adler32.New()
+	}
+	return c
+}
+
+// write writes header of stream before the first frame and deflated frame
+func (c *compressor) write(w io.Writer, f *frame) (int, error) {
+	var b []byte
+	if !c.started {
+		c.started = true
+		if c.encoding == "gzip" {
+			b = append(b, 0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff)
+		} else {
+			b = append(b, 0x78, 0x9c)
+		}
+	}
+	io.WriteString(c.sum, f.msg)
+	c.size += uint32(len(f.msg))
+	return w.Write(append(b, f.deflated()...))
+}
+
+// close writes final block and trailer of stream
+func (c *compressor) close(w io.Writer) error {
+	if !c.started {
+		return nil
+	}
+	b := append([]byte(nil), finalBlock...)
+	if c.encoding == "gzip" {
+		b = binary.LittleEndian.AppendUint32(b, c.sum.Sum32())
+		b = binary.LittleEndian.AppendUint32(b, c.size)
+	} else {
+		b = binary.BigEndian.AppendUint32(b, c.sum.Sum32())
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// negotiateEncoding returns gzip or deflate from header Accept-Encoding, gzip
+// is preferred if quality is equal. Empty string means no compression
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				q = v
+			}
+		}
+		if (name == "gzip" || name == "deflate") && q > 0 && (q > bestQ || q == bestQ && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,144 @@
+package sse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                            "",
+		"gzip":                        "gzip",
+		"deflate, gzip":               "gzip",
+		"gzip;q=0.5, deflate":         "deflate",
+		"GZIP;q=0":                    "",
+		"br, identity":                "",
+		"deflate;q=0.8, gzip;q=0.8":   "gzip",
+		" deflate ; q=1.0 , br;q=1.0": "deflate",
+	} {
+		if encoding := negotiateEncoding(header); encoding != expected {
+			t.Errorf("%q expected: %q\ngot: %q", header, expected, encoding)
+		}
+	}
+}
+
+func TestCompressorSharedFrame(t *testing.T) {
+	shared := newFrame("data:shared\n\n")
+	for _, encoding := range []string{"gzip", "deflate"} {
+		var b bytes.Buffer
+		c := newCompressor(encoding)
+		c.write(&b, newFrame("data:own "+encoding+"\n\n"))
+		c.write(&b, shared)
+		c.close(&b)
+		var r io.Reader
+		var err error
+		if encoding == "gzip" {
+			r, err = gzip.NewReader(&b)
+		} else {
+			r, err = zlib.NewReader(&b)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Checksum is checked at the end of stream
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "data:own " + encoding + "\n\ndata:shared\n\n"; string(data) != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, data)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:       time.Second * 3,
+		Compression: true,
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	bodies := make(map[string]io.ReadCloser)
+	for _, encoding := range []string{"gzip", "deflate"} {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "first " + encoding}})
+		}()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != encoding {
+			t.Errorf("expected: %s\ngot: %s", encoding, resp.Header.Get("Content-Encoding"))
+		}
+		bodies[encoding] = resp.Body
+	}
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "second"}})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := serveSSE.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for encoding, body := range bodies {
+		var r io.Reader
+		var err error
+		if encoding == "gzip" {
+			r, err = gzip.NewReader(body)
+		} else {
+			r, err = zlib.NewReader(body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: %s", encoding, err)
+		}
+		if !bytes.Contains(data, []byte("data:second\n")) {
+			t.Errorf("%s expected second event\ngot:\n%s", encoding, data)
+		}
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:       time.Second * 3,
+		Compression: true,
+	})
+	encodings := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings <- r.Header.Get("Accept-Encoding")
+		serveSSE.HandlerHTTP(1, w, r)
+	}))
+	defer server.Close()
+	go func() {
+		<-encodings
+		time.Sleep(100 * time.Millisecond)
+		serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "compressed"}})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client := NewClient(server.URL)
+	events := make(chan []byte, 1)
+	go client.SubscribeChanWithContext(ctx, "", events)
+	select {
+	case data := <-events:
+		if string(data) != "compressed" {
+			t.Errorf("expected: compressed\ngot: %s", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("event was not received")
+	}
+	cancel()
+	serveSSE.Close()
+}
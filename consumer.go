@@ -1,28 +1,52 @@
 package sse
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 )
 
-// A configConsumer represents a information about field retry in first event
-// additional headers and w(ResponseWriter) for write these headers
+// A configConsumer represents a information about field retry and size of
+// padding comment in preamble, additional headers and w(ResponseWriter) for
+// write these headers, overflow policy of main queue, heartbeat interval,
+// timeout of writing event, function to notify about lag, metrics, negotiated
+// compression, limits of batch, default ttl of events, function to count
+// expired events, size of queues, rate limit and clock of heartbeat
 type configConsumer struct {
-	w      http.ResponseWriter
-	retry  *time.Duration
-	header map[string]string
+	w               http.ResponseWriter
+	retry           time.Duration
+	padding         int
+	header          map[string]string
+	overflow        OverflowPolicy
+	overflowTimeout time.Duration
+	heartbeat       time.Duration
+	writeTimeout    time.Duration
+	lag             func(*consumer)
+	metrics         Metrics
+	encoding        string
+	batchLatency    time.Duration
+	batchBytes      int
+	ttl             time.Duration
+	expired         func(*consumer, int)
+	queueSize       int
+	rateLimit       *RateLimit
+	clock           Clock
 }
 
 // A Reconnect represents a information about recovery client, CID - id
-// consumer`s, ID - id last event and StopRecovery. StopRecovery closes channel
-// recovery and function MUST BE called in any case after send lost event to
-// continue working
+// consumer`s, ConnID - id of connection for EventRecovery, Identity - identity
+// from Authenticator, ID - id last event and StopRecovery. StopRecovery closes
+// recovery queue and function MUST BE called in any case after send lost
+// event to continue working
 type Reconnect struct {
 	CID      interface{}
+	ConnID   uint64
+	Identity interface{}
 	ID       string
 	consumer *consumer
 }
@@ -31,96 +55,391 @@ func (r *Reconnect) StopRecovery() {
 	r.consumer.closeRecovery()
 }
 
-// A mxClose represents a mutex for waiting close event
-type mxClose struct {
-	sync.Mutex
-	close bool
+// A Connection represents a information about connected or disconnected
+// consumer, CID - id consumer`s, ConnID - id of connection, Identity -
+// identity from Authenticator, Connected is false after disconnection and
+// Reason is reason of it. First is true for the first connection of CID and
+// Last is true for disconnection of the last connection of CID
+type Connection struct {
+	CID       interface{}
+	ConnID    uint64
+	Identity  interface{}
+	Connected bool
+	First     bool
+	Last      bool
+	Reason    DisconnectReason
 }
 
-// A consumer represents a information about consumer, which main channel has to
-// send events and reconnect channel to send priority events. Events is pushed into
-// reconnect channel when consumer had made reconnect to server. Main channel
-// not working when reconnect channel is working(pushing events) but safes sent event
-// in the amount of 50 events
+// A Lag represents a information about consumer which queue was full,
+// CID - id consumer`s, Policy - applied overflow policy, Dropped - count
+// dropped events since previous notification and Evicted is true if consumer
+// was disconnected
+type Lag struct {
+	CID     interface{}
+	Policy  OverflowPolicy
+	Dropped int
+	Evicted bool
+}
+
+// A consumer represents a information about consumer, which main queue has to
+// send events and recovery queue to send priority events. Events is pushed into
+// recovery queue when consumer had made reconnect to server. Main queue
+// not working when recovery queue is working(pushing events) but safes sent
+// events in the amount of queue size
 type consumer struct {
-	mainChannel, recoveryChannel chan string
-	context                      context.Context
-	cancelContext                context.CancelFunc
-	firstEvent                   struct {
-		exec  bool
-		retry time.Duration
+	mainQueue, recoveryQueue *queue
+	// CID of consumer and id of connection, last is true if connection was
+	// the last connection of CID when it was removed from map
+	cid           interface{}
+	id            uint64
+	last          bool
+	identity      interface{}
+	labels        map[string]string
+	context       context.Context
+	cancelContext context.CancelFunc
+	config        *configConsumer
+	// Controller flushes writer and sets write deadlines through wrappers
+	rc *http.ResponseController
+	// Compressor is nil if stream is not compressed
+	compressor *compressor
+	// Limiter is nil if rate is not limited
+	limiter *limiter
+	// Buffer of batch and sizes of written events are reused by serve
+	buf   bytes.Buffer
+	sizes []int
+	// Done is closed when consumer stopped writing
+	done chan struct{}
+	// Reason is set by the first closing
+	disconnect struct {
+		sync.Once
+		reason DisconnectReason
+	}
+	// Lag is collected until notification is sent
+	lagging struct {
+		sync.Mutex
+		dropped int
+		evicted bool
+		pending bool
 	}
-	waitCloseRecovery mxClose
-	config            *configConsumer
 }
 
 // newConsumer creates new consumer and start waiting events
 func newConsumer(cfg *configConsumer) *consumer {
 	cons := &consumer{
-		mainChannel:     make(chan string, 50),
-		recoveryChannel: make(chan string, 50),
-		config:          cfg,
+		mainQueue:     newQueue(cfg.queueSize),
+		recoveryQueue: newQueue(cfg.queueSize),
+		config:        cfg,
+		rc:            http.NewResponseController(cfg.w),
+		done:          make(chan struct{}),
+		limiter:       newLimiter(cfg.rateLimit),
 	}
 	// Set server side headers
 	cons.config.w.Header().Set("Content-Type", "text/event-stream")
 	cons.config.w.Header().Set("Cache-Control", "no-cache")
 	cons.config.w.Header().Set("Connection", "keep-alive")
+	// Disable buffering of nginx
+	cons.config.w.Header().Set("X-Accel-Buffering", "no")
 	// Set additional headers
 	for hname, hvalue := range cons.config.header {
 		cons.config.w.Header().Set(hname, hvalue)
 	}
+	if cfg.encoding != "" {
+		cons.compressor = newCompressor(cfg.encoding)
+		cons.config.w.Header().Set("Content-Encoding", cfg.encoding)
+		cons.config.w.Header().Add("Vary", "Accept-Encoding")
+	}
 
 	return cons
 }
 
-// serve reads all event and sends it
-func (c *consumer) serve(context context.Context, cancel context.CancelFunc) {
-	c.context = context
-	c.cancelContext = cancel
-	go c.closeWait()
+// serve writes preamble at once, reads all event and sends it. If heartbeat is
+// set, comment is sent when nothing has been written for heartbeat interval.
+// If batching is set, queued events are written together by one write and one
+// flush
+func (c *consumer) serve() {
+	defer close(c.done)
+	// Consumer stopped by closed main queue disconnects itself
+	defer c.cancelContext()
+	// Stream is long, so write timeout of server is removed
+	c.rc.SetWriteDeadline(time.Time{})
 	// Cover panic if http was closed unexpectedly
 	defer func() {
 		recover()
 	}()
-	f, _ := c.config.w.(http.Flusher)
+	defer c.finish()
+	// Headers and preamble are flushed before events, so client knows that
+	// stream is opened
+	if _, ok := c.write(c.preamble()); !ok {
+		return
+	}
+	var heartbeat <-chan time.Time
+	var timer Timer
+	if c.config.heartbeat > 0 {
+		timer = clockOr(c.config.clock).NewTimer(c.config.heartbeat)
+		defer timer.Stop()
+		heartbeat = timer.C()
+	}
 	// If reconnect happend, first reading will be priority events and just
-	// after close recoveryChannel from main channel
-	for message := range c.recoveryChannel {
-		if !c.firstEvent.exec {
-			c.addFieldRetry(&message)
+	// after close recovery queue from main queue
+	current := c.recoveryQueue
+	var batch []*frame
+	for {
+		select {
+		case <-current.ready:
+			msg, open := current.pop()
+			if msg == nil {
+				if open {
+					continue
+				}
+				if current == c.mainQueue {
+					return
+				}
+				current = c.mainQueue
+				continue
+			}
+			batch = append(batch[:0], msg)
+			if c.config.batchBytes > 0 {
+				batch = c.collect(current, batch)
+			}
+		case <-heartbeat:
+			if _, ok := c.write(heartbeatFrame); !ok {
+				return
+			}
+			timer.Reset(c.config.heartbeat)
+			continue
+		case <-c.context.Done():
+			return
+		}
+		// Events which waited longer than ttl are not sent, then rate limit
+		// delays or drops events
+		batch = c.dropExpired(batch)
+		var ok bool
+		if batch, ok = c.limit(batch); !ok {
+			return
+		}
+		if len(batch) > 0 {
+			start := time.Now()
+			sizes, ok := c.write(batch...)
+			if !ok {
+				return
+			}
+			flush := time.Since(start)
+			for _, n := range sizes {
+				c.config.metrics.Sent(c.context.Value(consumerKey), n, flush)
+			}
+			c.config.metrics.Queue(c.context.Value(consumerKey), c.mainQueue.len(), c.recoveryQueue.len())
+			if timer != nil {
+				timer.Reset(c.config.heartbeat)
+			}
 		}
-		fmt.Fprint(c.config.w, message)
-		f.Flush()
 	}
-	for message := range c.mainChannel {
-		if !c.firstEvent.exec {
-			c.addFieldRetry(&message)
+}
+
+// preamble returns padding comment for buffering proxies and field retry,
+// retry is not sent if it is not set
+func (c *consumer) preamble() *frame {
+	var b strings.Builder
+	if c.config.padding > 0 {
+		b.WriteString(":")
+		b.WriteString(strings.Repeat(" ", c.config.padding))
+		b.WriteString("\n")
+	}
+	if c.config.retry > 0 {
+		fmt.Fprintf(&b, "retry:%d\n", c.config.retry/time.Millisecond)
+	}
+	if b.Len() > 0 {
+		b.WriteString("\n")
+	}
+	return newFrame(b.String())
+}
+
+// dropExpired removes expired events from batch and counts them
+func (c *consumer) dropExpired(batch []*frame) []*frame {
+	now := time.Now()
+	n := 0
+	for _, msg := range batch {
+		if !msg.expired(now, c.config.ttl) {
+			batch[n] = msg
+			n++
 		}
-		fmt.Fprint(c.config.w, message)
-		f.Flush()
 	}
+	if n < len(batch) && c.config.expired != nil {
+		c.config.expired(c, len(batch)-n)
+	}
+	return batch[:n]
 }
 
-// closeWait listens to the closing of the http connection via the CloseNotifier
-// and context closing
-func (c *consumer) closeWait() {
-	// HTTP connection will be closed either consumer close itself or
-	// its close server
-	select {
-	case <-c.config.w.(http.CloseNotifier).CloseNotify():
-		c.cancelContext()
-	case <-c.context.Done():
+// collect appends events of queue to batch until size of batch reaches batch
+// bytes. If batch latency is set, it waits next events during latency,
+// otherwise only queued events are taken
+func (c *consumer) collect(q *queue, batch []*frame) []*frame {
+	size := len(batch[0].msg)
+	var latency <-chan time.Time
+	if c.config.batchLatency > 0 {
+		timer := time.NewTimer(c.config.batchLatency)
+		defer timer.Stop()
+		latency = timer.C
+	}
+	for size < c.config.batchBytes {
+		msg, open := q.pop()
+		if msg == nil {
+			if !open || latency == nil {
+				return batch
+			}
+			select {
+			case <-q.ready:
+				continue
+			case <-latency:
+				return batch
+			case <-c.context.Done():
+				return batch
+			}
+		}
+		batch = append(batch, msg)
+		size += len(msg.msg)
+	}
+	return batch
+}
+
+// write writes messages, compressed if compression is negotiated, by one
+// writing and flushes them. Deadline of writing is set if write timeout is
+// set. It returns count of written bytes of every message, error of writing
+// disconnects consumer
+func (c *consumer) write(messages ...*frame) ([]int, bool) {
+	if c.config.writeTimeout > 0 {
+		c.rc.SetWriteDeadline(time.Now().Add(c.config.writeTimeout))
+	}
+	var w io.Writer = c.config.w
+	if len(messages) > 1 {
+		c.buf.Reset()
+		w = &c.buf
+	}
+	c.sizes = c.sizes[:0]
+	var err error
+	for _, message := range messages {
+		var n int
+		if c.compressor != nil {
+			n, err = c.compressor.write(w, message)
+		} else {
+			n, err = io.WriteString(w, message.msg)
+		}
+		c.sizes = append(c.sizes, n)
+	}
+	if err == nil && len(messages) > 1 {
+		_, err = c.config.w.Write(c.buf.Bytes())
+	}
+	if err == nil {
+		err = c.rc.Flush()
+	}
+	if err != nil {
+		c.close(DisconnectClient)
+		return c.sizes, false
+	}
+	return c.sizes, true
+}
+
+// finish ends compressed stream
+func (c *consumer) finish() {
+	if c.compressor != nil && c.compressor.close(c.config.w) == nil {
+		c.rc.Flush()
 	}
 }
 
-// addFieldRetry adds by event retry field
-func (c *consumer) addFieldRetry(message *string) {
-	if !strings.Contains(*message, "retry") {
-		tmp := *message
-		*message = tmp[0:len(tmp)-2] +
-			fmt.Sprintf("\nretry:%d\n\n", *c.config.retry/time.Millisecond)
+// canFlush checks that writer or writer wrapped by it supports flushing, like
+// http.ResponseController finds it
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case http.Flusher, interface{ FlushError() error }:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
 	}
-	c.firstEvent.exec = true
+}
+
+// send pushes event into main queue according to overflow policy.
+// Map of consumers MUST BE locked for reading
+func (c *consumer) send(msg *frame) {
+	c.push(c.mainQueue, msg)
+}
+
+// sendRecovery pushes priority event into recovery queue according to
+// overflow policy. Event is dropped if recovery queue is closed
+func (c *consumer) sendRecovery(msg *frame) {
+	c.push(c.recoveryQueue, msg)
+}
+
+// push pushes event into queue, if queue is full overflow policy is applied
+func (c *consumer) push(q *queue, msg *frame) {
+	if c.context.Err() != nil {
+		return
+	}
+	if q.push(msg) {
+		return
+	}
+	switch c.config.overflow {
+	case OverflowDropNewest:
+		c.lag(false)
+	case OverflowDropOldest:
+		q.shift(msg)
+		c.lag(false)
+	case OverflowDisconnect:
+		c.close(DisconnectOverflow)
+		c.lag(true)
+	default:
+		var timeout <-chan time.Time
+		if c.config.overflowTimeout > 0 {
+			timer := time.NewTimer(c.config.overflowTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		for !q.push(msg) {
+			select {
+			case <-q.free:
+			case <-c.context.Done():
+				return
+			case <-timeout:
+				c.close(DisconnectOverflow)
+				c.lag(true)
+				return
+			}
+		}
+	}
+}
+
+// lag collects dropped event or disconnection of consumer. Only the first
+// lag before sending notification requests it, the next are aggregated
+func (c *consumer) lag(evicted bool) {
+	c.lagging.Lock()
+	if evicted {
+		c.lagging.evicted = true
+	} else {
+		c.lagging.dropped++
+	}
+	pending := c.lagging.pending
+	c.lagging.pending = true
+	c.lagging.Unlock()
+	if !pending && c.config.lag != nil {
+		c.config.lag(c)
+	}
+}
+
+// takeLag returns collected lag and resets it
+func (c *consumer) takeLag() *Lag {
+	c.lagging.Lock()
+	defer c.lagging.Unlock()
+	info := &Lag{
+		CID:     c.context.Value(consumerKey),
+		Policy:  c.config.overflow,
+		Dropped: c.lagging.dropped,
+		Evicted: c.lagging.evicted,
+	}
+	c.lagging.dropped = 0
+	c.lagging.pending = false
+	return info
 }
 
 // recovery checks exist Last-Event-ID in http.Request
@@ -128,6 +447,8 @@ func (c *consumer) recovery(r *http.Request) (*Reconnect, bool) {
 	if r.Header.Get("Last-Event-ID") != "" {
 		return &Reconnect{
 			CID:      r.Context().Value(consumerKey),
+			ConnID:   c.id,
+			Identity: c.identity,
 			ID:       r.Header.Get("Last-Event-ID"),
 			consumer: c,
 		}, true
@@ -137,17 +458,54 @@ func (c *consumer) recovery(r *http.Request) (*Reconnect, bool) {
 	}
 }
 
-// close disconnects consumer
-func (c *consumer) close() {
+// replay sends lost events into recovery queue and closes it
+func (c *consumer) replay(msgs []*frame) {
+	defer c.closeRecovery()
+	for _, msg := range msgs {
+		if !c.pushRecovery(msg) {
+			return
+		}
+	}
+}
+
+// pushRecovery waits free place in recovery queue, returns false if
+// recovery queue was closed or consumer was disconnected
+func (c *consumer) pushRecovery(msg *frame) bool {
+	for {
+		if c.recoveryQueue.isClosed() {
+			return false
+		}
+		if c.recoveryQueue.push(msg) {
+			return true
+		}
+		select {
+		case <-c.recoveryQueue.free:
+		case <-c.context.Done():
+			return false
+		}
+	}
+}
+
+// close disconnects consumer, reason of the first closing is saved
+func (c *consumer) close(reason DisconnectReason) {
+	c.setReason(reason)
 	c.cancelContext()
 }
 
-// closeRecovery closes recovery channel to allow read from main channel
+// setReason saves reason of disconnection, if it was not saved
+func (c *consumer) setReason(reason DisconnectReason) {
+	c.disconnect.Do(func() {
+		c.disconnect.reason = reason
+	})
+}
+
+// reason returns reason of disconnection. Consumer MUST BE stopped
+func (c *consumer) reason() DisconnectReason {
+	c.setReason(DisconnectClient)
+	return c.disconnect.reason
+}
+
+// closeRecovery closes recovery queue to allow read from main queue
 func (c *consumer) closeRecovery() {
-	c.waitCloseRecovery.Lock()
-	defer c.waitCloseRecovery.Unlock()
-	if !c.waitCloseRecovery.close {
-		close(c.recoveryChannel)
-		c.waitCloseRecovery.close = true
-	}
+	c.recoveryQueue.close()
 }
@@ -0,0 +1,140 @@
+package sse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestConsumer(policy OverflowPolicy, timeout time.Duration) (*consumer, chan *consumer) {
+	lags := make(chan *consumer, 10)
+	cons := newConsumer(&configConsumer{
+		w:               httptest.NewRecorder(),
+		overflow:        policy,
+		overflowTimeout: timeout,
+		queueSize:       50,
+		lag: func(c *consumer) {
+			lags <- c
+		},
+	})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), consumerKey, 1))
+	cons.context, cons.cancelContext = ctx, cancel
+	for count := 1; count <= len(cons.mainQueue.items); count++ {
+		cons.send(newFrame(strconv.Itoa(count)))
+	}
+	return cons, lags
+}
+
+func expectLag(t *testing.T, lags chan *consumer, dropped int, evicted bool) {
+	select {
+	case cons := <-lags:
+		info := cons.takeLag()
+		if info.CID != 1 || info.Dropped != dropped || info.Evicted != evicted {
+			t.Errorf("expected: dropped %d, evicted %v\ngot: %+v", dropped, evicted, info)
+		}
+	default:
+		t.Error("lag was not notified")
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	cons, lags := newTestConsumer(OverflowDropNewest, 0)
+	cons.send(newFrame("51"))
+	cons.send(newFrame("52"))
+	expectLag(t, lags, 2, false)
+	if len(lags) != 0 {
+		t.Error("lags were not aggregated")
+	}
+	if msg, _ := cons.mainQueue.pop(); msg.msg != "1" {
+		t.Errorf("expected: 1\ngot: %s", msg.msg)
+	}
+	if cons.context.Err() != nil {
+		t.Error("consumer was disconnected")
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	cons, lags := newTestConsumer(OverflowDropOldest, 0)
+	cons.send(newFrame("51"))
+	expectLag(t, lags, 1, false)
+	if msg, _ := cons.mainQueue.pop(); msg.msg != "2" {
+		t.Errorf("expected: 2\ngot: %s", msg.msg)
+	}
+	var last string
+	for cons.mainQueue.len() != 0 {
+		msg, _ := cons.mainQueue.pop()
+		last = msg.msg
+	}
+	if last != "51" {
+		t.Errorf("expected: 51\ngot: %s", last)
+	}
+}
+
+func TestOverflowBlockTimeout(t *testing.T) {
+	cons, lags := newTestConsumer(OverflowBlock, 50*time.Millisecond)
+	start := time.Now()
+	cons.send(newFrame("51"))
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("send did not wait timeout")
+	}
+	if cons.context.Err() == nil {
+		t.Error("consumer was not disconnected")
+	}
+	expectLag(t, lags, 0, true)
+
+	cons, lags = newTestConsumer(OverflowBlock, time.Second)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cons.mainQueue.pop()
+	}()
+	cons.send(newFrame("51"))
+	if cons.context.Err() != nil || len(lags) != 0 {
+		t.Error("consumer was disconnected")
+	}
+}
+
+func TestOverflowRecovery(t *testing.T) {
+	cons, lags := newTestConsumer(OverflowDropNewest, 0)
+	for count := 1; count <= len(cons.recoveryQueue.items)+1; count++ {
+		cons.sendRecovery(newFrame(strconv.Itoa(count)))
+	}
+	expectLag(t, lags, 1, false)
+	cons.closeRecovery()
+	// Closed recovery channel drops event
+	cons.sendRecovery(newFrame("52"))
+}
+
+func TestExpiredEvents(t *testing.T) {
+	w := &flushWriter{header: make(http.Header), keep: true}
+	cons := newBatchConsumer(w, 0, 0)
+	cons.config.ttl = 50 * time.Millisecond
+	expired := 0
+	cons.config.expired = func(c *consumer, count int) {
+		expired += count
+	}
+	old := time.Now().Add(-time.Second)
+	stale := newFrame("data:stale\n\n")
+	stale.created = old
+	forever := newEventFrame("data:forever\n\n", -1, "")
+	forever.created = old
+	long := newEventFrame("data:long\n\n", time.Hour, "")
+	long.created = old
+	short := newEventFrame("data:short\n\n", time.Millisecond, "")
+	short.created = time.Now().Add(-10 * time.Millisecond)
+	for _, msg := range []*frame{stale, forever, long, short, newFrame("data:fresh\n\n")} {
+		cons.send(msg)
+	}
+	cons.mainQueue.close()
+	cons.serve()
+	written := strings.Join(w.written(), "")
+	if written != "retry:1000\n\ndata:forever\n\ndata:long\n\ndata:fresh\n\n" {
+		t.Errorf("unexpected events:\n%s", written)
+	}
+	if expired != 2 {
+		t.Errorf("expected: 2 expired\ngot: %d", expired)
+	}
+}
@@ -0,0 +1,169 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bom is UTF-8 byte order mark, which is stripped from the start of stream
+var bom = []byte("\xEF\xBB\xBF")
+
+// A Decoder represents a parser of event stream, which implements parsing
+// algorithm of WHATWG specification. Lines can be ended with CRLF, LF or CR,
+// comments are skipped, fields retry and id are saved in decoder
+type Decoder struct {
+	r           *bufio.Reader
+	started     bool
+	skipLF      bool
+	lastEventID string
+	dispatchID  string
+	retry       time.Duration
+	eventType   string
+	data        strings.Builder
+}
+
+// NewDecoder creates new decoder which reads stream from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Decode reads stream until next event is dispatched. Event without name is
+// dispatched with name "message". Unfinished event at the end of stream is
+// discarded and error of reading is returned
+func (d *Decoder) Decode() (*Event, error) {
+	if !d.started {
+		d.started = true
+		if prefix, err := d.r.Peek(len(bom)); err == nil && bytes.Equal(prefix, bom) {
+			d.r.Discard(len(bom))
+		}
+	}
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			if e := d.dispatch(); e != nil {
+				return e, nil
+			}
+			continue
+		}
+		d.processLine(line)
+	}
+}
+
+// Retry returns reconnection time from last field retry, zero if server has
+// not sent it
+func (d *Decoder) Retry() time.Duration {
+	return d.retry
+}
+
+// LastEventID returns last event ID from stream, which is updated by every
+// dispatch, even if event has no data
+func (d *Decoder) LastEventID() string {
+	return d.dispatchID
+}
+
+// setLastEventID sets last event ID before reading stream
+func (d *Decoder) setLastEventID(id string) {
+	d.lastEventID, d.dispatchID = id, id
+}
+
+// readLine reads line which is ended with CRLF, LF or CR
+func (d *Decoder) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		// LF after CR is the end of previous line
+		if d.skipLF {
+			d.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+		switch b {
+		case '\n':
+			return line, nil
+		case '\r':
+			d.skipLF = true
+			return line, nil
+		}
+		line = append(line, b)
+	}
+}
+
+// processLine processes field of event, comments are ignored
+func (d *Decoder) processLine(line []byte) {
+	if line[0] == ':' {
+		return
+	}
+	field, value := line, []byte(nil)
+	if i := bytes.IndexByte(line, ':'); i != -1 {
+		field, value = line[:i], line[i+1:]
+		if len(value) != 0 && value[0] == ' ' {
+			value = value[1:]
+		}
+	}
+	switch string(field) {
+	case "event":
+		d.eventType = string(value)
+	case "data":
+		d.data.Write(value)
+		d.data.WriteByte('\n')
+	case "id":
+		if bytes.IndexByte(value, 0) == -1 {
+			d.lastEventID = string(value)
+		}
+	case "retry":
+		if isDigits(value) {
+			if ms, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				d.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// dispatch creates event from buffers and resets them. It returns nil if
+// data buffer is empty
+func (d *Decoder) dispatch() *Event {
+	d.dispatchID = d.lastEventID
+	eventType := d.eventType
+	d.eventType = ""
+	if d.data.Len() == 0 {
+		return nil
+	}
+	data := d.data.String()
+	d.data.Reset()
+	if eventType == "" {
+		eventType = "message"
+	}
+	return &Event{
+		Event: eventType,
+		Data: &DataEvent{
+			Value: strings.TrimSuffix(data, "\n"),
+		},
+		ID: d.lastEventID,
+	}
+}
+
+// isDigits checks that value consists of ASCII digits only
+func isDigits(value []byte) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, b := range value {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
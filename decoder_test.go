@@ -0,0 +1,77 @@
+package sse
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeAll(t *testing.T, stream string) (*Decoder, []*Event) {
+	dec := NewDecoder(strings.NewReader(stream))
+	var events []*Event
+	for {
+		e, err := dec.Decode()
+		if err == io.EOF {
+			return dec, events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		expect []Event
+	}{
+		{"simple", "data:testMessage\n\n", []Event{{Event: "message", Data: &DataEvent{Value: "testMessage"}}}},
+		{"multiline", "data:testMessage1\ndata: testMessage2\n\n", []Event{{Event: "message", Data: &DataEvent{Value: "testMessage1\ntestMessage2"}}}},
+		{"fields", "event: notification\ndata:testMessage\nid:11\n\n", []Event{{Event: "notification", Data: &DataEvent{Value: "testMessage"}, ID: "11"}}},
+		{"data with id", "data:id:1\n\n", []Event{{Event: "message", Data: &DataEvent{Value: "id:1"}}}},
+		{"crlf", "data:testMessage\r\n\r\ndata:testMessage2\r\rdata:3\n\n", []Event{
+			{Event: "message", Data: &DataEvent{Value: "testMessage"}},
+			{Event: "message", Data: &DataEvent{Value: "testMessage2"}},
+			{Event: "message", Data: &DataEvent{Value: "3"}},
+		}},
+		{"bom", "\xEF\xBB\xBFdata:testMessage\n\n", []Event{{Event: "message", Data: &DataEvent{Value: "testMessage"}}}},
+		{"comment", ": ping\n\n:comment\ndata:testMessage\n\n", []Event{{Event: "message", Data: &DataEvent{Value: "testMessage"}}}},
+		{"empty values", "data\ndata:\nid:\n\n", []Event{{Event: "message", Data: &DataEvent{Value: "\n"}}}},
+		{"no data", "event:notification\nid:1\n\ndata:testMessage\n\n", []Event{{Event: "message", Data: &DataEvent{Value: "testMessage"}, ID: "1"}}},
+		{"unfinished", "data:testMessage\n\ndata:lost\n", []Event{{Event: "message", Data: &DataEvent{Value: "testMessage"}}}},
+		{"unknown field", "error:1\ndata:testMessage\n\n", []Event{{Event: "message", Data: &DataEvent{Value: "testMessage"}}}},
+	}
+	for _, tt := range tests {
+		_, events := decodeAll(t, tt.stream)
+		if len(events) != len(tt.expect) {
+			t.Errorf("%s: expected %d events\ngot: %d", tt.name, len(tt.expect), len(events))
+			continue
+		}
+		for i, e := range events {
+			if e.Event != tt.expect[i].Event || e.ID != tt.expect[i].ID || e.Data.Value != tt.expect[i].Data.Value {
+				t.Errorf("%s: expected:\n%+v %q\ngot:\n%+v %q", tt.name, tt.expect[i], tt.expect[i].Data.Value, e, e.Data.Value)
+			}
+		}
+	}
+}
+
+func TestDecoderRetry(t *testing.T) {
+	dec, _ := decodeAll(t, "retry:4000\n\nretry:1x\n\n")
+	if dec.Retry() != 4*time.Second {
+		t.Errorf("expected: %s\ngot: %s", 4*time.Second, dec.Retry())
+	}
+}
+
+func TestDecoderLastEventID(t *testing.T) {
+	dec, events := decodeAll(t, "id:1\ndata:testMessage\n\nid:2\n\nid:3\n")
+	if len(events) != 1 || events[0].ID != "1" {
+		t.Errorf("expected one event with id 1\ngot: %v", events)
+	}
+	// Event without data updates last event ID, unfinished event does not
+	if dec.LastEventID() != "2" {
+		t.Errorf("expected: 2\ngot: %s", dec.LastEventID())
+	}
+}
@@ -13,11 +13,12 @@ type DataEvent struct {
 	DisabledFormatting bool
 }
 
-// formattingEvent creates format server side event
+// formattingEvent creates format server side event, retry is not added if it
+// is zero
 func formattingEvent(event string, data struct {
 	Value              string
 	DisabledFormatting bool
-}, id string) string {
+}, id string, retry time.Duration) string {
 	var eventMsg bytes.Buffer
 	if event != "" {
 		eventMsg.WriteString(fmt.Sprintf("event:%s\n", strings.Replace(event, "\n", "", -1)))
@@ -35,6 +36,9 @@ func formattingEvent(event string, data struct {
 	if id != "" {
 		eventMsg.WriteString(fmt.Sprintf("id:%s\n", strings.Replace(id, "\n", "", -1)))
 	}
+	if retry > 0 {
+		eventMsg.WriteString(fmt.Sprintf("retry:%d\n", retry/time.Millisecond))
+	}
 
 	eventMsg.WriteString("\n\n")
 	return eventMsg.String()
@@ -45,58 +49,80 @@ type eventer interface {
 	dispatch(*mpConsumer)
 }
 
-// A Event represents an event to send all consumers
+// A Event represents an event to send all consumers. Retry is sent with event
+// if it is set, it changes time of reconnecting only consumers which got it
+// TTL is time which event can wait in queue of consumer, expired event is not
+// sent. Zero TTL means TTL of config, negative means no expiry. Event with Key
+// replaces queued event of consumer with the same Key, so consumer which is
+// behind gets only the latest value of Key. TTL and Key of other events work
+// the same
 type Event struct {
 	eventer
 	Event string
 	Data  *DataEvent
 	ID    string
+	Retry time.Duration
 	Error string
+	TTL   time.Duration
+	Key   string
 }
 
 // dispatch sends event all consumers
 func (e *Event) dispatch(cons *mpConsumer) {
-	msg := formattingEvent(e.Event, *e.Data, e.ID)
+	msg := newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, e.Retry), e.TTL, e.Key)
 	cons.RLock()
 	defer cons.RUnlock()
-	for _, consumer := range cons.value {
-		consumer.mainChannel <- msg
-	}
+	cons.each(func(consumer *consumer) {
+		consumer.send(msg)
+	})
 }
 
-// A EventOnly represents an event to send only clients with UCID
+// A EventOnly represents an event to send only clients with UCID. Event is
+// sent to all connections of CID, if ConnID is set only to connection with
+// ConnID, such event is not published through broker. Retry is sent with event
+// if it is set, so retry of single consumer can be changed
 type EventOnly struct {
 	eventer
-	CID   []interface{}
-	Event string
-	Data  *DataEvent
-	Error string
-	ID    string
+	CID    []interface{}
+	ConnID uint64
+	Event  string
+	Data   *DataEvent
+	Error  string
+	ID     string
+	Retry  time.Duration
+	TTL    time.Duration
+	Key    string
 }
 
 // dispatch sends event only clients with CID
 func (e *EventOnly) dispatch(cons *mpConsumer) {
-	msg := formattingEvent(e.Event, *e.Data, e.ID)
+	msg := newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, e.Retry), e.TTL, e.Key)
 	cons.RLock()
 	defer cons.RUnlock()
 	for _, CID := range e.CID {
-		if consumer, ok := cons.value[CID]; ok {
-			consumer.mainChannel <- msg
+		for _, consumer := range cons.value[CID] {
+			if e.ConnID == 0 || consumer.id == e.ConnID {
+				consumer.send(msg)
+			}
 		}
 	}
 }
 
-// A EventExcept represents an event to send except clients with CID
+// A EventExcept represents an event to send except clients with CID. Retry is
+// sent with event if it is set
 type EventExcept struct {
 	eventer
 	CID   []interface{}
 	Event string
 	Data  *DataEvent
 	ID    string
+	Retry time.Duration
+	TTL   time.Duration
+	Key   string
 }
 
 // isValue checks exist value in list
-func (e *EventExcept) isValue(value interface{}, list []interface{}) bool {
+func isValue(value interface{}, list []interface{}) bool {
 	for _, v := range list {
 		if v == value {
 			return true
@@ -107,38 +133,104 @@ func (e *EventExcept) isValue(value interface{}, list []interface{}) bool {
 
 // dispatch sends event only except clients with CID
 func (e *EventExcept) dispatch(cons *mpConsumer) {
-	msg := formattingEvent(e.Event, *e.Data, e.ID)
+	msg := newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, e.Retry), e.TTL, e.Key)
+	cons.RLock()
+	defer cons.RUnlock()
+	for CID, consumers := range cons.value {
+		if !isValue(CID, e.CID) {
+			for _, consumer := range consumers {
+				consumer.send(msg)
+			}
+		}
+	}
+}
+
+// A EventStream represents an event to send only consumers which are
+// subscribed to stream
+type EventStream struct {
+	eventer
+	Stream string
+	Event  string
+	Data   *DataEvent
+	ID     string
+	TTL    time.Duration
+	Key    string
+}
+
+// dispatch sends event only consumers of stream
+func (e *EventStream) dispatch(cons *mpConsumer) {
+	msg := newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, 0), e.TTL, e.Key)
+	cons.RLock()
+	defer cons.RUnlock()
+	for consumer := range cons.streams[e.Stream] {
+		consumer.send(msg)
+	}
+}
+
+// A EventSelector represents an event to send only consumers which labels
+// match selector, see ParseSelector. Event with invalid selector is not sent
+type EventSelector struct {
+	eventer
+	Selector string
+	Event    string
+	Data     *DataEvent
+	ID       string
+	TTL      time.Duration
+	Key      string
+}
+
+// dispatch sends event only consumers matched by selector
+func (e *EventSelector) dispatch(cons *mpConsumer) {
+	selector, err := ParseSelector(e.Selector)
+	if err != nil {
+		return
+	}
+	msg := newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, 0), e.TTL, e.Key)
 	cons.RLock()
 	defer cons.RUnlock()
-	for CID, consumer := range cons.value {
-		if !e.isValue(CID, e.CID) {
-			consumer.mainChannel <- msg
+	send := func(consumer *consumer) {
+		if selector.Matches(consumer.labels) {
+			consumer.send(msg)
 		}
 	}
+	candidates, ok := selector.candidates(cons)
+	if !ok {
+		cons.each(send)
+		return
+	}
+	for consumer := range candidates {
+		send(consumer)
+	}
 }
 
 // A EventRecovery represents an priority event to send only one client with CID
-// which there are fulfilled conditions open recovery channel.
+// which there are fulfilled conditions open recovery channel. If ConnID is set,
+// event is sent only to connection with ConnID from Reconnect
 type EventRecovery struct {
 	eventer
-	CID   interface{}
-	Event string
-	Data  *DataEvent
-	ID    string
+	CID    interface{}
+	ConnID uint64
+	Event  string
+	Data   *DataEvent
+	ID     string
+	TTL    time.Duration
 }
 
 // dispatch sends priority event to send only one client with CID
 func (e *EventRecovery) dispatch(cons *mpConsumer) {
-	msg := formattingEvent(e.Event, *e.Data, e.ID)
+	msg := newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, 0), e.TTL, "")
 	cons.RLock()
 	defer cons.RUnlock()
-	if consumer, ok := cons.value[e.CID]; ok {
-		consumer.recoveryChannel <- msg
+	for _, consumer := range cons.value[e.CID] {
+		if e.ConnID == 0 || consumer.id == e.ConnID {
+			consumer.sendRecovery(msg)
+		}
 	}
 }
 
 // A EventRetry represents an event to send time in seconds which it means time
-// waitting reconnecting consumer to server
+// waitting reconnecting consumer to server. It is sent to all consumers and
+// consumers connected later get it in preamble
 type EventRetry struct {
 	eventer
 	Time time.Duration
@@ -146,10 +238,77 @@ type EventRetry struct {
 
 // dispatch sends event to send all consumers
 func (e *EventRetry) dispatch(cons *mpConsumer) {
-	msg := fmt.Sprintf("retry:%d\n\n", e.Time/time.Millisecond)
+	msg := newEventFrame(fmt.Sprintf("retry:%d\n\n", e.Time/time.Millisecond), -1, "")
+	cons.RLock()
+	defer cons.RUnlock()
+	cons.each(func(consumer *consumer) {
+		consumer.send(msg)
+	})
+}
+
+// A EventComment represents a comment which is ignored by client, it can keep
+// connection or help debugging of stream. Comment is sent to all consumers, if
+// CID is set only to consumers with CID or except them if Except is true, if
+// Stream is set only to consumers of stream. Comment is not saved in replay log
+type EventComment struct {
+	eventer
+	Comment string
+	CID     []interface{}
+	Except  bool
+	Stream  string
+	TTL     time.Duration
+}
+
+// formattingComment creates comment, every line of text is prefixed by colon
+func formattingComment(text string) string {
+	var msg bytes.Buffer
+	for _, line := range strings.Split(text, "\n") {
+		msg.WriteString(fmt.Sprintf(": %s\n", strings.Replace(line, "\r", "", -1)))
+	}
+	return msg.String()
+}
+
+// dispatch sends comment to matched consumers
+func (e *EventComment) dispatch(cons *mpConsumer) {
+	msg := newEventFrame(formattingComment(e.Comment), e.TTL, "")
 	cons.RLock()
 	defer cons.RUnlock()
-	for _, consumer := range cons.value {
-		consumer.mainChannel <- msg
+	send := func(consumer *consumer) {
+		if len(e.CID) == 0 || isValue(consumer.cid, e.CID) != e.Except {
+			consumer.send(msg)
+		}
+	}
+	if e.Stream != "" {
+		for consumer := range cons.streams[e.Stream] {
+			send(consumer)
+		}
+		return
+	}
+	cons.each(send)
+}
+
+// A eventShutdown represents a last event which is sent to all consumers
+// before shutdown, retry is sent without changing retry of config
+type eventShutdown struct {
+	eventer
+	event *Event
+	retry time.Duration
+}
+
+// dispatch sends retry and event all consumers
+func (e *eventShutdown) dispatch(cons *mpConsumer) {
+	var msgs []*frame
+	if e.retry > 0 {
+		msgs = append(msgs, newEventFrame(fmt.Sprintf("retry:%d\n\n", e.retry/time.Millisecond), -1, ""))
+	}
+	if e.event != nil {
+		msgs = append(msgs, newEventFrame(formattingEvent(e.event.Event, *e.event.Data, e.event.ID, e.event.Retry), -1, ""))
 	}
+	cons.RLock()
+	defer cons.RUnlock()
+	cons.each(func(consumer *consumer) {
+		for _, msg := range msgs {
+			consumer.send(msg)
+		}
+	})
 }
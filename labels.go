@@ -0,0 +1,225 @@
+package sse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A selectorOperator represents a operator of requirement of selector
+type selectorOperator int
+
+const (
+	selectorEquals selectorOperator = iota
+	selectorNotEquals
+	selectorIn
+	selectorNotIn
+	selectorExists
+	selectorNotExists
+)
+
+// A requirement represents a condition of one label
+type requirement struct {
+	key      string
+	operator selectorOperator
+	values   []string
+}
+
+// matches checks label of consumer
+func (r *requirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.operator {
+	case selectorEquals, selectorIn:
+		return ok && containsString(r.values, value)
+	case selectorNotEquals, selectorNotIn:
+		return !ok || !containsString(r.values, value)
+	case selectorExists:
+		return ok
+	}
+	return !ok
+}
+
+// A Selector represents a list of requirements to labels of consumer, all
+// requirements have to be met
+type Selector []requirement
+
+// ParseSelector parses selector. Requirements are separated by comma:
+// "key=value" or "key==value" (equality), "key!=value" (inequality),
+// "key in (a,b)" and "key notin (a,b)" (set membership), "key" (label exists)
+// and "!key" (label does not exist)
+func ParseSelector(selector string) (Selector, error) {
+	var result Selector
+	for _, part := range splitSelector(selector) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// splitSelector splits selector by commas which are not in parentheses
+func splitSelector(selector string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+// parseRequirement parses one requirement of selector
+func parseRequirement(part string) (requirement, error) {
+	if strings.HasPrefix(part, "!") && !strings.Contains(part, "=") {
+		return newRequirement(part[1:], selectorNotExists, nil)
+	}
+	fields := strings.Fields(part)
+	if len(fields) >= 2 && (fields[1] == "in" || fields[1] == "notin") {
+		set := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(part[len(fields[0]):]), fields[1]))
+		if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+			return requirement{}, fmt.Errorf("sse: selector %q: values have to be in parentheses", part)
+		}
+		var values []string
+		for _, value := range strings.Split(set[1:len(set)-1], ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+		operator := selectorIn
+		if fields[1] == "notin" {
+			operator = selectorNotIn
+		}
+		return newRequirement(fields[0], operator, values)
+	}
+	for _, op := range []struct {
+		token    string
+		operator selectorOperator
+	}{{"!=", selectorNotEquals}, {"==", selectorEquals}, {"=", selectorEquals}} {
+		if i := strings.Index(part, op.token); i != -1 {
+			return newRequirement(part[:i], op.operator, []string{strings.TrimSpace(part[i+len(op.token):])})
+		}
+	}
+	return newRequirement(part, selectorExists, nil)
+}
+
+// newRequirement checks key and creates requirement
+func newRequirement(key string, operator selectorOperator, values []string) (requirement, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || strings.ContainsAny(key, " \t=!(),") {
+		return requirement{}, fmt.Errorf("sse: selector: invalid key %q", key)
+	}
+	return requirement{key: key, operator: operator, values: values}, nil
+}
+
+// Matches checks that labels meet all requirements
+func (s Selector) Matches(labels map[string]string) bool {
+	for i := range s {
+		if !s[i].matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns consumers which can match selector using index of
+// labels. It returns false if selector has no positive requirement and all
+// consumers have to be checked. Map MUST BE locked
+func (s Selector) candidates(cons *mpConsumer) (map[*consumer]struct{}, bool) {
+	var best map[*consumer]struct{}
+	found := false
+	for i := range s {
+		r := &s[i]
+		var set map[*consumer]struct{}
+		switch r.operator {
+		case selectorEquals, selectorIn:
+			set = cons.selectValues(r.key, r.values)
+		case selectorExists:
+			set = cons.selectValues(r.key, nil)
+		default:
+			continue
+		}
+		if !found || len(set) < len(best) {
+			best, found = set, true
+		}
+	}
+	return best, found
+}
+
+// selectValues returns consumers with label key, which value is in values.
+// Nil values mean any value. Map MUST BE locked
+func (m *mpConsumer) selectValues(key string, values []string) map[*consumer]struct{} {
+	index := m.labels[key]
+	if values == nil {
+		set := make(map[*consumer]struct{})
+		for _, consumers := range index {
+			for cons := range consumers {
+				set[cons] = struct{}{}
+			}
+		}
+		return set
+	}
+	if len(values) == 1 {
+		return index[values[0]]
+	}
+	set := make(map[*consumer]struct{})
+	for _, value := range values {
+		for cons := range index[value] {
+			set[cons] = struct{}{}
+		}
+	}
+	return set
+}
+
+// indexLabels adds consumer in index of labels. Map MUST BE locked
+func (m *mpConsumer) indexLabels(cons *consumer) {
+	for key, value := range cons.labels {
+		values, ok := m.labels[key]
+		if !ok {
+			values = make(map[string]map[*consumer]struct{})
+			m.labels[key] = values
+		}
+		if values[value] == nil {
+			values[value] = make(map[*consumer]struct{})
+		}
+		values[value][cons] = struct{}{}
+	}
+}
+
+// unindexLabels removes consumer from index of labels. Map MUST BE locked
+func (m *mpConsumer) unindexLabels(cons *consumer) {
+	for key, value := range cons.labels {
+		consumers := m.labels[key][value]
+		if _, ok := consumers[cons]; !ok {
+			continue
+		}
+		delete(consumers, cons)
+		if len(consumers) == 0 {
+			delete(m.labels[key], value)
+			if len(m.labels[key]) == 0 {
+				delete(m.labels, key)
+			}
+		}
+	}
+}
+
+// containsString checks exist value in list
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
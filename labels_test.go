@@ -0,0 +1,132 @@
+package sse
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{"user": "42", "tenant": "acme", "role": "admin"}
+	for selector, expected := range map[string]bool{
+		"":                            true,
+		"user=42":                     true,
+		"user==42, tenant=acme":       true,
+		"user!=42":                    false,
+		"tenant in (acme, foo)":       true,
+		"tenant notin (acme,foo)":     false,
+		"role notin (guest),user":     true,
+		"banned":                      false,
+		"!banned, role=admin":         true,
+		"!role":                       false,
+		"device!=phone":               true,
+		"tenant in (foo),user=42":     false,
+		"user=42,tenant in (bar,baz)": false,
+	} {
+		s, err := ParseSelector(selector)
+		if err != nil {
+			t.Errorf("%q: %s", selector, err)
+			continue
+		}
+		if s.Matches(labels) != expected {
+			t.Errorf("%q expected: %t", selector, expected)
+		}
+	}
+	for _, selector := range []string{"tenant in acme", "=42", "user name=1", "!"} {
+		if _, err := ParseSelector(selector); err == nil {
+			t.Errorf("%q expected error", selector)
+		}
+	}
+}
+
+func TestSelectorIndex(t *testing.T) {
+	cons := &mpConsumer{
+		labels: make(map[string]map[string]map[*consumer]struct{}),
+	}
+	consumers := make(map[string]*consumer)
+	for cid, labels := range map[string]map[string]string{
+		"a": {"tenant": "acme", "role": "admin"},
+		"b": {"tenant": "acme"},
+		"c": {"tenant": "foo", "role": "admin"},
+	} {
+		consumers[cid] = &consumer{cid: cid, labels: labels}
+		cons.indexLabels(consumers[cid])
+	}
+	s, _ := ParseSelector("tenant in (acme,foo),role=admin")
+	candidates, ok := s.candidates(cons)
+	if !ok || len(candidates) != 2 {
+		t.Errorf("expected: 2 candidates\ngot: %d", len(candidates))
+	}
+	s, _ = ParseSelector("!role")
+	if _, ok := s.candidates(cons); ok {
+		t.Error("expected scan of all consumers")
+	}
+	cons.unindexLabels(consumers["c"])
+	if _, ok := cons.labels["tenant"]["foo"]; ok {
+		t.Error("expected removed value from index")
+	}
+}
+
+func TestSendEventSelector(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:      time.Second * 3,
+		ReplaySize: 10,
+	})
+	labels := map[string]map[string]string{
+		"a": {"user": "1", "tenant": "acme", "role": "admin"},
+		"b": {"user": "2", "tenant": "acme"},
+		"c": {"user": "3", "tenant": "foo"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cid := r.URL.Query().Get("cid")
+		serveSSE.HandlerHTTPOptions(cid, &ConsumerOptions{Labels: labels[cid]}, w, r)
+	}))
+	defer server.Close()
+	conns := make(map[string]net.Conn)
+	for _, cid := range []string{"a", "b", "c"} {
+		conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+		defer conn.Close()
+		conn.Write([]byte("GET /?cid=" + cid + " HTTP/1.1\nHost: foo\n\n"))
+		conns[cid] = conn
+	}
+	time.Sleep(100 * time.Millisecond)
+	serveSSE.SendEvent(&EventSelector{
+		Selector: "tenant=acme,role!=admin",
+		Data:     &DataEvent{Value: "selected"},
+		ID:       "1",
+	})
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "all"}, ID: "2"})
+	for cid, expected := range map[string]bool{"a": false, "b": true, "c": false} {
+		resp := readUntil(t, conns[cid], "data:all\n")
+		if strings.Contains(resp, "data:selected\n") != expected {
+			t.Errorf("consumer %s expected selected: %t\ngot:\n%s", cid, expected, resp)
+		}
+	}
+	// Replay log keeps selector
+	conns["b"].Close()
+	time.Sleep(100 * time.Millisecond)
+	serveSSE.SendEvent(&EventSelector{
+		Selector: "tenant=acme",
+		Data:     &DataEvent{Value: "missed"},
+		ID:       "3",
+	})
+	serveSSE.SendEvent(&EventSelector{
+		Selector: "tenant=foo",
+		Data:     &DataEvent{Value: "other"},
+		ID:       "4",
+	})
+	time.Sleep(100 * time.Millisecond)
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET /?cid=b HTTP/1.1\nHost: foo\nLast-Event-ID: 2\n\n"))
+	time.Sleep(100 * time.Millisecond)
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "next"}, ID: "5"})
+	resp := readUntil(t, conn, "data:next\n")
+	if !strings.Contains(resp, "data:missed\n") || strings.Contains(resp, "data:other\n") {
+		t.Errorf("unexpected replay:\n%s", resp)
+	}
+	serveSSE.Close()
+}
@@ -0,0 +1,293 @@
+package sse
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A DisconnectReason represents a reason of disconnection consumer
+type DisconnectReason int
+
+const (
+	// DisconnectClient is closed connection or error of writing
+	DisconnectClient DisconnectReason = iota
+	// DisconnectRemoved is RemoveConsumer
+	DisconnectRemoved
+	// DisconnectOverflow is eviction by overflow policy
+	DisconnectOverflow
+	// DisconnectShutdown is Close or Shutdown of side event
+	DisconnectShutdown
+)
+
+// String returns name of reason
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClient:
+		return "client"
+	case DisconnectRemoved:
+		return "removed"
+	case DisconnectOverflow:
+		return "overflow"
+	case DisconnectShutdown:
+		return "shutdown"
+	}
+	return "unknown"
+}
+
+// A Metrics represents a hook which receives measurements of side event.
+// Connected is called when consumer connected, reconnect is true if it sent
+// Last-Event-ID. Dispatched is called with time of dispatching event to all
+// consumers. Sent is called with size of event written to consumer and time of
+// flushing. Queue is called with count events in main and recovery queues
+// of consumer after every writing. Expired is called with count events which
+// were dropped because of TTL. Limited is called with count events dropped by
+// rate limit or with time of delaying by rate limit. Methods are called
+// concurrently
+type Metrics interface {
+	Connected(cid interface{}, reconnect bool)
+	Disconnected(cid interface{}, reason DisconnectReason)
+	Dispatched(time.Duration)
+	Sent(cid interface{}, bytes int, flush time.Duration)
+	Queue(cid interface{}, main, recovery int)
+	Expired(cid interface{}, count int)
+	Limited(cid interface{}, dropped int, delay time.Duration)
+}
+
+// nopMetrics is used when metrics are not set
+type nopMetrics struct{}
+
+func (nopMetrics) Connected(interface{}, bool)                {}
+func (nopMetrics) Disconnected(interface{}, DisconnectReason) {}
+func (nopMetrics) Dispatched(time.Duration)                   {}
+func (nopMetrics) Sent(interface{}, int, time.Duration)       {}
+func (nopMetrics) Queue(interface{}, int, int)                {}
+func (nopMetrics) Expired(interface{}, int)                   {}
+func (nopMetrics) Limited(interface{}, int, time.Duration)    {}
+
+// durationBuckets are upper bounds of histograms in seconds
+var durationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// A histogram represents a distribution of durations
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(durationBuckets))}
+}
+
+// observe adds duration in histogram
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// write writes histogram in Prometheus text format
+func (h *histogram) write(b *strings.Builder, name, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(b, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(b, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// A consumerMetrics represents a measurements of connected consumer, which
+// can have many connections
+type consumerMetrics struct {
+	connections    int
+	events         uint64
+	bytes          uint64
+	expired        uint64
+	limited        uint64
+	delay          time.Duration
+	main, recovery int
+}
+
+// A PrometheusMetrics represents a metrics which are exposed by ServeHTTP in
+// Prometheus text format. Series of consumer are removed after disconnection
+// of its last connection
+type PrometheusMetrics struct {
+	mx          sync.Mutex
+	connections map[bool]uint64
+	open        int
+	disconnects map[DisconnectReason]uint64
+	events      uint64
+	bytes       uint64
+	expired     uint64
+	limited     uint64
+	delay       time.Duration
+	dispatch    *histogram
+	flush       *histogram
+	consumers   map[interface{}]*consumerMetrics
+}
+
+// NewPrometheusMetrics creates metrics with Prometheus exposition
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		connections: make(map[bool]uint64),
+		disconnects: make(map[DisconnectReason]uint64),
+		dispatch:    newHistogram(),
+		flush:       newHistogram(),
+		consumers:   make(map[interface{}]*consumerMetrics),
+	}
+}
+
+// Connected counts connection
+func (m *PrometheusMetrics) Connected(cid interface{}, reconnect bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.connections[reconnect]++
+	m.open++
+	if _, ok := m.consumers[cid]; !ok {
+		m.consumers[cid] = &consumerMetrics{}
+	}
+	m.consumers[cid].connections++
+}
+
+// Disconnected counts disconnection by reason
+func (m *PrometheusMetrics) Disconnected(cid interface{}, reason DisconnectReason) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.disconnects[reason]++
+	m.open--
+	if cons, ok := m.consumers[cid]; ok {
+		if cons.connections--; cons.connections == 0 {
+			delete(m.consumers, cid)
+		}
+	}
+}
+
+// Dispatched observes time of dispatching
+func (m *PrometheusMetrics) Dispatched(d time.Duration) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.dispatch.observe(d)
+}
+
+// Sent counts event written to consumer and observes time of flushing
+func (m *PrometheusMetrics) Sent(cid interface{}, bytes int, flush time.Duration) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.events++
+	m.bytes += uint64(bytes)
+	m.flush.observe(flush)
+	if cons, ok := m.consumers[cid]; ok {
+		cons.events++
+		cons.bytes += uint64(bytes)
+	}
+}
+
+// Queue saves fill of channels of consumer
+func (m *PrometheusMetrics) Queue(cid interface{}, main, recovery int) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if cons, ok := m.consumers[cid]; ok {
+		cons.main, cons.recovery = main, recovery
+	}
+}
+
+// Expired counts events dropped by TTL
+func (m *PrometheusMetrics) Expired(cid interface{}, count int) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.expired += uint64(count)
+	if cons, ok := m.consumers[cid]; ok {
+		cons.expired += uint64(count)
+	}
+}
+
+// Limited counts events dropped by rate limit and time of delaying
+func (m *PrometheusMetrics) Limited(cid interface{}, dropped int, delay time.Duration) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.limited += uint64(dropped)
+	m.delay += delay
+	if cons, ok := m.consumers[cid]; ok {
+		cons.limited += uint64(dropped)
+		cons.delay += delay
+	}
+}
+
+// ServeHTTP writes metrics in Prometheus text format
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, m.String())
+}
+
+// String returns metrics in Prometheus text format
+func (m *PrometheusMetrics) String() string {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	var b strings.Builder
+	b.WriteString("# HELP sse_connections_total Connected consumers.\n# TYPE sse_connections_total counter\n")
+	fmt.Fprintf(&b, "sse_connections_total{type=\"new\"} %d\n", m.connections[false])
+	fmt.Fprintf(&b, "sse_connections_total{type=\"reconnect\"} %d\n", m.connections[true])
+	b.WriteString("# HELP sse_consumers Currently connected consumers.\n# TYPE sse_consumers gauge\n")
+	fmt.Fprintf(&b, "sse_consumers %d\n", len(m.consumers))
+	b.WriteString("# HELP sse_open_connections Currently open connections.\n# TYPE sse_open_connections gauge\n")
+	fmt.Fprintf(&b, "sse_open_connections %d\n", m.open)
+	b.WriteString("# HELP sse_disconnects_total Disconnected consumers by reason.\n# TYPE sse_disconnects_total counter\n")
+	for _, reason := range []DisconnectReason{DisconnectClient, DisconnectRemoved, DisconnectOverflow, DisconnectShutdown} {
+		fmt.Fprintf(&b, "sse_disconnects_total{reason=%q} %d\n", reason, m.disconnects[reason])
+	}
+	b.WriteString("# HELP sse_events_sent_total Events written to consumers.\n# TYPE sse_events_sent_total counter\n")
+	fmt.Fprintf(&b, "sse_events_sent_total %d\n", m.events)
+	b.WriteString("# HELP sse_bytes_sent_total Bytes of events written to consumers.\n# TYPE sse_bytes_sent_total counter\n")
+	fmt.Fprintf(&b, "sse_bytes_sent_total %d\n", m.bytes)
+	b.WriteString("# HELP sse_events_expired_total Events dropped because of TTL.\n# TYPE sse_events_expired_total counter\n")
+	fmt.Fprintf(&b, "sse_events_expired_total %d\n", m.expired)
+	b.WriteString("# HELP sse_events_rate_dropped_total Events dropped by rate limit.\n# TYPE sse_events_rate_dropped_total counter\n")
+	fmt.Fprintf(&b, "sse_events_rate_dropped_total %d\n", m.limited)
+	b.WriteString("# HELP sse_rate_delay_seconds_total Time of delaying events by rate limit.\n# TYPE sse_rate_delay_seconds_total counter\n")
+	fmt.Fprintf(&b, "sse_rate_delay_seconds_total %g\n", m.delay.Seconds())
+	m.dispatch.write(&b, "sse_dispatch_duration_seconds", "Time of dispatching event to all consumers.")
+	m.flush.write(&b, "sse_flush_duration_seconds", "Time of writing and flushing event.")
+	// Series of consumers are sorted by CID
+	cids := make([]string, 0, len(m.consumers))
+	consumers := make(map[string]*consumerMetrics, len(m.consumers))
+	for cid, cons := range m.consumers {
+		name := fmt.Sprint(cid)
+		cids = append(cids, name)
+		consumers[name] = cons
+	}
+	sort.Strings(cids)
+	b.WriteString("# HELP sse_consumer_bytes_sent_total Bytes of events written to consumer.\n# TYPE sse_consumer_bytes_sent_total counter\n")
+	for _, cid := range cids {
+		fmt.Fprintf(&b, "sse_consumer_bytes_sent_total{cid=%q} %d\n", cid, consumers[cid].bytes)
+	}
+	b.WriteString("# HELP sse_consumer_events_sent_total Events written to consumer.\n# TYPE sse_consumer_events_sent_total counter\n")
+	for _, cid := range cids {
+		fmt.Fprintf(&b, "sse_consumer_events_sent_total{cid=%q} %d\n", cid, consumers[cid].events)
+	}
+	b.WriteString("# HELP sse_consumer_events_expired_total Events of consumer dropped because of TTL.\n# TYPE sse_consumer_events_expired_total counter\n")
+	for _, cid := range cids {
+		fmt.Fprintf(&b, "sse_consumer_events_expired_total{cid=%q} %d\n", cid, consumers[cid].expired)
+	}
+	b.WriteString("# HELP sse_consumer_events_rate_dropped_total Events of consumer dropped by rate limit.\n# TYPE sse_consumer_events_rate_dropped_total counter\n")
+	for _, cid := range cids {
+		fmt.Fprintf(&b, "sse_consumer_events_rate_dropped_total{cid=%q} %d\n", cid, consumers[cid].limited)
+	}
+	b.WriteString("# HELP sse_consumer_rate_delay_seconds_total Time of delaying events of consumer by rate limit.\n# TYPE sse_consumer_rate_delay_seconds_total counter\n")
+	for _, cid := range cids {
+		fmt.Fprintf(&b, "sse_consumer_rate_delay_seconds_total{cid=%q} %g\n", cid, consumers[cid].delay.Seconds())
+	}
+	b.WriteString("# HELP sse_consumer_queue Queued events of consumer.\n# TYPE sse_consumer_queue gauge\n")
+	for _, cid := range cids {
+		fmt.Fprintf(&b, "sse_consumer_queue{cid=%q,queue=\"main\"} %d\n", cid, consumers[cid].main)
+		fmt.Fprintf(&b, "sse_consumer_queue{cid=%q,queue=\"recovery\"} %d\n", cid, consumers[cid].recovery)
+	}
+	return b.String()
+}
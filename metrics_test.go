@@ -0,0 +1,65 @@
+package sse
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	serveSSE := New(&Config{
+		Retry:   time.Second * 3,
+		Metrics: metrics,
+	})
+	disconnected := make(chan interface{}, 1)
+	serveSSE.HandlerDisconnectNotify(func(id interface{}) {
+		disconnected <- id
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	time.Sleep(100 * time.Millisecond)
+	for _, value := range []string{"first", "second"} {
+		serveSSE.SendEvent(&Event{Data: &DataEvent{Value: value}})
+	}
+	readUntil(t, conn, "data:second\n")
+	// Metrics are saved after flushing
+	time.Sleep(50 * time.Millisecond)
+	for _, expecting := range []string{
+		"sse_connections_total{type=\"new\"} 1\n",
+		"sse_consumers 1\n",
+		"sse_events_sent_total 2\n",
+		"sse_dispatch_duration_seconds_count 2\n",
+		"sse_flush_duration_seconds_count 2\n",
+		"sse_consumer_events_sent_total{cid=\"1\"} 2\n",
+		"sse_consumer_queue{cid=\"1\",queue=\"main\"} 0\n",
+	} {
+		if !strings.Contains(metrics.String(), expecting) {
+			t.Errorf("expected:\n%s\ngot:\n%s\n", expecting, metrics.String())
+		}
+	}
+	serveSSE.RemoveConsumer(1)
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("consumer was not disconnected")
+	}
+	resp := httptest.NewRecorder()
+	metrics.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expecting := range []string{
+		"sse_consumers 0\n",
+		"sse_disconnects_total{reason=\"removed\"} 1\n",
+		"sse_disconnects_total{reason=\"client\"} 0\n",
+	} {
+		if !strings.Contains(resp.Body.String(), expecting) {
+			t.Errorf("expected:\n%s\ngot:\n%s\n", expecting, resp.Body.String())
+		}
+	}
+	serveSSE.Close()
+}
@@ -0,0 +1,145 @@
+package sse
+
+import "sync"
+
+// A queue represents a queue of events of consumer. Events are kept in order
+// of sending, event with key replaces queued event with the same key in place,
+// so consumer which is behind gets only the latest event of key and order of
+// events without key is kept. Queue is limited by size, conflated event does
+// not need free place
+type queue struct {
+	mx    sync.Mutex
+	items []*frame
+	head  int
+	count int
+	// Keys are positions of queued events with key in items
+	keys   map[string]int
+	closed bool
+	// Ready has signal when queue has events or it was closed
+	ready chan struct{}
+	// Free has signal when event was taken from queue
+	free chan struct{}
+}
+
+// newQueue creates queue of size
+func newQueue(size int) *queue {
+	return &queue{
+		items: make([]*frame, size),
+		keys:  make(map[string]int),
+		ready: make(chan struct{}, 1),
+		free:  make(chan struct{}, 1),
+	}
+}
+
+// signal sends signal into channel without blocking
+func signal(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
+
+// push appends event or replaces queued event with the same key, returns false
+// if queue is full. Event is dropped if queue is closed
+func (q *queue) push(f *frame) bool {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if q.closed {
+		return true
+	}
+	if f.key != "" {
+		if i, ok := q.keys[f.key]; ok {
+			q.items[i] = f
+			return true
+		}
+	}
+	if q.count == len(q.items) {
+		return false
+	}
+	q.append(f)
+	return true
+}
+
+// shift drops the oldest event and appends event, if queue is full
+func (q *queue) shift(f *frame) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if q.closed {
+		return
+	}
+	if f.key != "" {
+		if i, ok := q.keys[f.key]; ok {
+			q.items[i] = f
+			return
+		}
+	}
+	if q.count == len(q.items) {
+		q.take()
+	}
+	q.append(f)
+}
+
+// append adds event to the end of queue. Queue MUST BE locked and MUST NOT be full
+func (q *queue) append(f *frame) {
+	i := (q.head + q.count) % len(q.items)
+	q.items[i] = f
+	q.count++
+	if f.key != "" {
+		q.keys[f.key] = i
+	}
+	signal(q.ready)
+}
+
+// take removes the first event. Queue MUST BE locked and MUST NOT be empty
+func (q *queue) take() *frame {
+	f := q.items[q.head]
+	q.items[q.head] = nil
+	if f.key != "" {
+		delete(q.keys, f.key)
+	}
+	q.head = (q.head + 1) % len(q.items)
+	q.count--
+	signal(q.free)
+	return f
+}
+
+// pop takes the first event, it returns nil if queue is empty and false if
+// queue is closed and empty. Signal of ready is kept while queue has events or
+// it is closed
+func (q *queue) pop() (*frame, bool) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if q.count == 0 {
+		if q.closed {
+			signal(q.ready)
+		}
+		return nil, !q.closed
+	}
+	f := q.take()
+	if q.count > 0 || q.closed {
+		signal(q.ready)
+	}
+	return f, true
+}
+
+// close closes queue, queued events can be taken
+func (q *queue) close() {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	q.closed = true
+	signal(q.ready)
+}
+
+// isClosed checks that queue was closed
+func (q *queue) isClosed() bool {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	return q.closed
+}
+
+// len returns count queued events
+func (q *queue) len() int {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	return q.count
+}
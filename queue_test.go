@@ -0,0 +1,111 @@
+package sse
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func queued(q *queue) string {
+	var msgs []string
+	for {
+		msg, _ := q.pop()
+		if msg == nil {
+			return strings.Join(msgs, ",")
+		}
+		msgs = append(msgs, msg.msg)
+	}
+}
+
+func TestQueueConflation(t *testing.T) {
+	q := newQueue(4)
+	for _, msg := range []*frame{
+		newEventFrame("a1", 0, "a"),
+		newFrame("x"),
+		newEventFrame("b1", 0, "b"),
+		newEventFrame("a2", 0, "a"),
+		newFrame("y"),
+		newEventFrame("b2", 0, "b"),
+	} {
+		if !q.push(msg) {
+			t.Fatalf("%s was not pushed", msg.msg)
+		}
+	}
+	// Queue is full, but event with queued key replaces event
+	if q.push(newFrame("z")) {
+		t.Error("full queue accepted event")
+	}
+	if !q.push(newEventFrame("a3", 0, "a")) {
+		t.Error("event with queued key was not conflated")
+	}
+	if msgs := queued(q); msgs != "a3,x,b2,y" {
+		t.Errorf("expected: a3,x,b2,y\ngot: %s", msgs)
+	}
+	// Key is released after taking event
+	q.push(newEventFrame("a4", 0, "a"))
+	q.push(newEventFrame("a5", 0, "a"))
+	if msgs := queued(q); msgs != "a5" {
+		t.Errorf("expected: a5\ngot: %s", msgs)
+	}
+}
+
+func TestQueueShift(t *testing.T) {
+	q := newQueue(2)
+	q.push(newEventFrame("a1", 0, "a"))
+	q.push(newFrame("x"))
+	q.shift(newFrame("y"))
+	// Key of dropped event is released
+	q.shift(newEventFrame("a2", 0, "a"))
+	if msgs := queued(q); msgs != "y,a2" {
+		t.Errorf("expected: y,a2\ngot: %s", msgs)
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	q := newQueue(2)
+	q.push(newFrame("x"))
+	q.close()
+	if !q.push(newFrame("y")) {
+		t.Error("closed queue did not drop event")
+	}
+	<-q.ready
+	if msg, open := q.pop(); msg == nil || msg.msg != "x" || !open {
+		t.Errorf("expected: x\ngot: %v", msg)
+	}
+	select {
+	case <-q.ready:
+	default:
+		t.Error("closed queue has no signal")
+	}
+	if msg, open := q.pop(); msg != nil || open {
+		t.Error("closed queue is open")
+	}
+}
+
+func TestConflationLaggingConsumer(t *testing.T) {
+	w := &flushWriter{header: make(http.Header), keep: true}
+	cons := newBatchConsumer(w, 0, 0)
+	for _, price := range []string{"1", "2", "3"} {
+		(&Event{Data: &DataEvent{Value: "EURUSD " + price}, Key: "EURUSD"}).dispatch(&mpConsumer{
+			value: map[interface{}][]*consumer{1: {cons}},
+		})
+		cons.send(newFrame("data:trade " + price + "\n\n"))
+	}
+	cons.mainQueue.close()
+	cons.serve()
+	written := strings.Join(w.written(), "")
+	expected := "retry:1000\n\ndata:EURUSD 3\n\n\ndata:trade 1\n\ndata:trade 2\n\ndata:trade 3\n\n"
+	if written != expected {
+		t.Errorf("expected:\n%q\ngot:\n%q", expected, written)
+	}
+}
+
+func TestQueueSize(t *testing.T) {
+	for size, expected := range map[int]int{0: 50, 2: 2} {
+		serveSSE := New(&Config{QueueSize: size}).(*SSE)
+		if serveSSE.queueSize() != expected {
+			t.Errorf("expected: %d\ngot: %d", expected, serveSSE.queueSize())
+		}
+		serveSSE.Close()
+	}
+}
@@ -0,0 +1,120 @@
+package sse
+
+import "time"
+
+// A RatePolicy represents a behaviour of consumer when writing of event
+// exceeds rate limit
+type RatePolicy int
+
+const (
+	// RateDelay delays writing until limit allows it, new events wait in
+	// queue of consumer, so overflow policy and conflation are applied to them
+	RateDelay RatePolicy = iota
+	// RateDrop drops event
+	RateDrop
+)
+
+// A RateLimit represents a limit of writing events to consumer. Events is
+// count events per second and Bytes is count bytes of events before
+// compression per second, EventsBurst and BytesBurst are capacities of
+// buckets, burst less than 1 is 1 event or the rate of bytes. Zero rate means
+// no limit
+type RateLimit struct {
+	Events      float64
+	EventsBurst int
+	Bytes       float64
+	BytesBurst  int
+	Policy      RatePolicy
+}
+
+// A limiter represents a token buckets of consumer
+type limiter struct {
+	events, bytes *tokenBucket
+	policy        RatePolicy
+}
+
+// newLimiter creates limiter of consumer, returns nil if limit is not set
+func newLimiter(limit *RateLimit) *limiter {
+	if limit == nil || limit.Events <= 0 && limit.Bytes <= 0 {
+		return nil
+	}
+	l := &limiter{policy: limit.Policy}
+	if limit.Events > 0 {
+		l.events = newTokenBucket(limit.Events, limit.EventsBurst)
+	}
+	if limit.Bytes > 0 {
+		burst := limit.BytesBurst
+		if burst < 1 {
+			burst = int(limit.Bytes)
+		}
+		l.bytes = newTokenBucket(limit.Bytes, burst)
+	}
+	return l
+}
+
+// take takes tokens of events and bytes and returns zero or returns time
+// until tokens of both buckets are available without taking them
+func (l *limiter) take(events, bytes int, now time.Time) time.Duration {
+	var wait time.Duration
+	if l.events != nil {
+		wait = l.events.delay(float64(events), now)
+	}
+	if l.bytes != nil {
+		if d := l.bytes.delay(float64(bytes), now); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		if l.events != nil {
+			l.events.tokens -= float64(events)
+		}
+		if l.bytes != nil {
+			l.bytes.tokens -= float64(bytes)
+		}
+	}
+	return wait
+}
+
+// limit applies rate limit to batch. RateDrop removes events which exceed
+// limit, RateDelay waits until limit allows whole batch. It returns false if
+// consumer was disconnected during waiting
+func (c *consumer) limit(batch []*frame) ([]*frame, bool) {
+	if c.limiter == nil {
+		return batch, true
+	}
+	cid := c.context.Value(consumerKey)
+	if c.limiter.policy == RateDrop {
+		now := time.Now()
+		n := 0
+		for _, msg := range batch {
+			if c.limiter.take(1, len(msg.msg), now) == 0 {
+				batch[n] = msg
+				n++
+			}
+		}
+		if n < len(batch) {
+			c.config.metrics.Limited(cid, len(batch)-n, 0)
+		}
+		return batch[:n], true
+	}
+	size := 0
+	for _, msg := range batch {
+		size += len(msg.msg)
+	}
+	start := time.Now()
+	wait := c.limiter.take(len(batch), size, start)
+	if wait == 0 {
+		return batch, true
+	}
+	for ; wait > 0; wait = c.limiter.take(len(batch), size, time.Now()) {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.context.Done():
+			timer.Stop()
+			return nil, false
+		}
+	}
+	c.config.metrics.Limited(cid, 0, time.Since(start))
+	return batch, true
+}
@@ -0,0 +1,94 @@
+package sse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLimitedConsumer(metrics Metrics, limit *RateLimit) (*consumer, *flushWriter) {
+	w := &flushWriter{header: make(http.Header), keep: true}
+	cons := newBatchConsumer(w, 0, 1<<10)
+	cons.config.metrics = metrics
+	cons.limiter = newLimiter(limit)
+	return cons, w
+}
+
+func TestLimiter(t *testing.T) {
+	if newLimiter(nil) != nil || newLimiter(&RateLimit{Policy: RateDrop}) != nil {
+		t.Error("limiter without rate was created")
+	}
+	now := time.Now()
+	l := newLimiter(&RateLimit{Events: 10, EventsBurst: 2, Bytes: 100})
+	if wait := l.take(2, 100, now); wait != 0 {
+		t.Errorf("expected: burst is available\ngot: wait %s", wait)
+	}
+	// Both buckets are empty, tokens are not taken while waiting
+	if wait := l.take(1, 50, now); wait != 500*time.Millisecond {
+		t.Errorf("expected: 500ms\ngot: %s", wait)
+	}
+	if wait := l.take(1, 10, now.Add(100*time.Millisecond)); wait != 0 {
+		t.Errorf("expected: no wait\ngot: %s", wait)
+	}
+}
+
+func TestRateDrop(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	metrics.Connected(1, false)
+	cons, w := newLimitedConsumer(metrics, &RateLimit{Events: 1, EventsBurst: 2, Policy: RateDrop})
+	for count := 1; count <= 5; count++ {
+		cons.send(newFrame(fmt.Sprintf("data:e%d\n\n", count)))
+	}
+	cons.mainQueue.close()
+	cons.serve()
+	if written := strings.Join(w.written(), ""); written != "retry:1000\n\ndata:e1\n\ndata:e2\n\n" {
+		t.Errorf("unexpected events:\n%s", written)
+	}
+	if !strings.Contains(metrics.String(), "sse_consumer_events_rate_dropped_total{cid=\"1\"} 3\n") {
+		t.Errorf("dropped events were not counted:\n%s", metrics.String())
+	}
+}
+
+func TestRateDelay(t *testing.T) {
+	for name, limit := range map[string]*RateLimit{
+		"events": {Events: 20},
+		"bytes":  {Bytes: 180, BytesBurst: 9},
+	} {
+		metrics := NewPrometheusMetrics()
+		metrics.Connected(1, false)
+		cons, w := newLimitedConsumer(metrics, limit)
+		// Batch is disabled, so every event waits
+		cons.config.batchBytes = 0
+		for count := 1; count <= 5; count++ {
+			cons.send(newFrame(fmt.Sprintf("data:e%d\n\n", count)))
+		}
+		cons.mainQueue.close()
+		start := time.Now()
+		cons.serve()
+		if elapsed := time.Since(start); elapsed < 190*time.Millisecond || elapsed > time.Second {
+			t.Errorf("%s expected: 200ms\ngot: %s", name, elapsed)
+		}
+		if events := strings.Count(strings.Join(w.written(), ""), "data:"); events != 5 {
+			t.Errorf("%s expected: 5 events\ngot: %d", name, events)
+		}
+		if strings.Contains(metrics.String(), "sse_consumer_rate_delay_seconds_total{cid=\"1\"} 0\n") {
+			t.Errorf("%s delay was not counted:\n%s", name, metrics.String())
+		}
+	}
+}
+
+func TestRateLimitOptions(t *testing.T) {
+	global := &RateLimit{Events: 10}
+	serveSSE := New(&Config{RateLimit: global}).(*SSE)
+	defer serveSSE.Close()
+	own := &RateLimit{}
+	if serveSSE.rateLimit(nil) != global || serveSSE.rateLimit(&ConsumerOptions{}) != global {
+		t.Error("global rate limit was not used")
+	}
+	// Empty limit of consumer disables global limit
+	if limit := serveSSE.rateLimit(&ConsumerOptions{RateLimit: own}); limit != own || newLimiter(limit) != nil {
+		t.Error("rate limit of consumer was not used")
+	}
+}
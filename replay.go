@@ -0,0 +1,132 @@
+package sse
+
+import (
+	"sync"
+	"time"
+)
+
+// A replayEntry represents a dispatched event saved in replay log. Accept
+// checks that consumer with cid, streams and labels is target of event, nil
+// means all consumers
+type replayEntry struct {
+	id     string
+	msg    *frame
+	time   time.Time
+	accept func(cid interface{}, streams []string, labels map[string]string) bool
+}
+
+// newReplayEntry creates entry of event, returns false if event is not saved
+// in replay log
+func newReplayEntry(event eventer) (replayEntry, bool) {
+	switch e := event.(type) {
+	case *Event:
+		return replayEntry{id: e.ID, msg: newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, e.Retry), e.TTL, e.Key)}, true
+	case *EventStream:
+		return replayEntry{
+			id:  e.ID,
+			msg: newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, 0), e.TTL, e.Key),
+			accept: func(cid interface{}, streams []string, labels map[string]string) bool {
+				for _, name := range streams {
+					if name == e.Stream {
+						return true
+					}
+				}
+				return false
+			},
+		}, true
+	case *EventOnly:
+		return replayEntry{
+			id:  e.ID,
+			msg: newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, e.Retry), e.TTL, e.Key),
+			accept: func(cid interface{}, streams []string, labels map[string]string) bool {
+				return isValue(cid, e.CID)
+			},
+		}, true
+	case *EventSelector:
+		selector, err := ParseSelector(e.Selector)
+		if err != nil {
+			return replayEntry{}, false
+		}
+		return replayEntry{
+			id:  e.ID,
+			msg: newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, 0), e.TTL, e.Key),
+			accept: func(cid interface{}, streams []string, labels map[string]string) bool {
+				return selector.Matches(labels)
+			},
+		}, true
+	case *EventExcept:
+		return replayEntry{
+			id:  e.ID,
+			msg: newEventFrame(formattingEvent(e.Event, *e.Data, e.ID, e.Retry), e.TTL, e.Key),
+			accept: func(cid interface{}, streams []string, labels map[string]string) bool {
+				return !isValue(cid, e.CID)
+			},
+		}, true
+	}
+	return replayEntry{}, false
+}
+
+// A replayLog represents a log of last dispatched events. It is used to send
+// lost events to consumer which reconnected with Last-Event-ID. Log is limited
+// by count events and age, zero value of any limit means no limit
+type replayLog struct {
+	sync.Mutex
+	entries []replayEntry
+	size    int
+	maxAge  time.Duration
+}
+
+// newReplayLog creates replay log, returns nil if replay is disabled in config
+func newReplayLog(cfg *Config) *replayLog {
+	if cfg.ReplaySize <= 0 && cfg.ReplayMaxAge <= 0 {
+		return nil
+	}
+	return &replayLog{
+		size:   cfg.ReplaySize,
+		maxAge: cfg.ReplayMaxAge,
+	}
+}
+
+// push saves event in log and removes old events. Log MUST BE locked
+func (l *replayLog) push(entry replayEntry) {
+	entry.time = time.Now()
+	l.entries = append(l.entries, entry)
+	if l.size > 0 && len(l.entries) > l.size {
+		l.entries = append(l.entries[:0], l.entries[len(l.entries)-l.size:]...)
+	}
+	l.expire()
+}
+
+// expire removes events which are older than max age. Log MUST BE locked
+func (l *replayLog) expire() {
+	if l.maxAge <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-l.maxAge)
+	i := 0
+	for i < len(l.entries) && l.entries[i].time.Before(deadline) {
+		i++
+	}
+	if i > 0 {
+		l.entries = append(l.entries[:0], l.entries[i:]...)
+	}
+}
+
+// since returns events for consumer with cid, streams and labels, which were
+// dispatched after event with id. It returns false if event with id is not
+// found in log. Log MUST BE locked
+func (l *replayLog) since(id string, cid interface{}, streams []string, labels map[string]string) ([]*frame, bool) {
+	l.expire()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if l.entries[i].id == id {
+			msgs := make([]*frame, 0, len(l.entries)-i-1)
+			for _, entry := range l.entries[i+1:] {
+				if entry.accept == nil || entry.accept(cid, streams, labels) {
+					msgs = append(msgs, entry.msg)
+				}
+			}
+			return msgs, true
+		}
+	}
+	return nil, false
+}
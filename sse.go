@@ -3,8 +3,11 @@ package sse
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,15 +18,118 @@ const (
 	consumerValue
 )
 
-// A Config represents a config to run SSE
+// A Config represents a config to run SSE. ReplaySize and ReplayMaxAge enable
+// replay log: events are saved and events after Last-Event-ID are sent
+// automatically to consumer which reconnected. Overflow is policy which is
+// applied when main queue of consumer is full, OverflowTimeout limits
+// waiting of OverflowBlock. QueueSize is size of main and recovery queues of
+// consumer, default is 50, event with Key replaces queued event with the same
+// Key without free place. RateLimit limits writing of events to every
+// consumer, it can be changed for consumer by ConsumerOptions.
+// Heartbeat is interval of sending comments to idle consumers.
+// MultipleConnections allows many connections with the same CID, otherwise
+// the second connection is rejected.
+// MaxConnections, MaxConnectionsPerIP and MaxConnectionsPerIdentity limit
+// connections, ConnectRate limits new connections per second with ConnectBurst.
+// ClientIP returns IP of client, default is remote address of request.
+// RetryAfter is sent to client rejected by limit or closed side event,
+// default is one second. WriteTimeout limits writing of every event, write
+// timeout of server does not work for long stream and it is removed.
+// Compression enables gzip or deflate negotiated by Accept-Encoding, every
+// event is compressed once for all consumers.
+// BatchLatency and BatchBytes enable batching: queued events of consumer are
+// written by one write and one flush, batch waits next events not longer than
+// BatchLatency and is not bigger than BatchBytes, default is 64KB.
+// Preamble with Retry and comment of Padding spaces is sent at once after
+// connection, padding pushes stream through buffering proxies.
+// EventTTL is default TTL of events, event which waited in queue of consumer
+// longer than TTL is dropped, zero means no expiry.
+// Clock is source of time for heartbeat, default is system time.
+// ShutdownEvent and ShutdownRetry are sent to all consumers by Shutdown before
+// they are disconnected, zero values are not sent. Broker transfers events
+// between side events of different servers. Metrics receives measurements
+// of side event. Authenticator authenticates consumers, CID returned by it
+// is used instead of CID of HandlerHTTP
 type Config struct {
-	Header map[string]string
-	Retry  time.Duration
+	Header              map[string]string
+	Retry               time.Duration
+	ReplaySize          int
+	ReplayMaxAge        time.Duration
+	Overflow            OverflowPolicy
+	OverflowTimeout     time.Duration
+	Heartbeat           time.Duration
+	ShutdownEvent       *Event
+	ShutdownRetry       time.Duration
+	Broker              Broker
+	Metrics             Metrics
+	Authenticator       Authenticator
+	MultipleConnections bool
+	// Admission control
+	MaxConnections            int
+	MaxConnectionsPerIP       int
+	MaxConnectionsPerIdentity int
+	ConnectRate               float64
+	ConnectBurst              int
+	ClientIP                  func(*http.Request) string
+	RetryAfter                time.Duration
+	WriteTimeout              time.Duration
+	Compression               bool
+	BatchLatency              time.Duration
+	BatchBytes                int
+	Padding                   int
+	EventTTL                  time.Duration
+	QueueSize                 int
+	RateLimit                 *RateLimit
+	Clock                     Clock
 }
 
+// A OverflowPolicy represents a behaviour of dispatcher when main queue of
+// consumer is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits free place in main queue. If OverflowTimeout is
+	// set, consumer is disconnected after timeout
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops new event
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest event in main queue
+	OverflowDropOldest
+	// OverflowDisconnect disconnects consumer
+	OverflowDisconnect
+)
+
+// A mpConsumer represents a map of connections of consumers by CID with index
+// of streams and index of labels: key, value and connections which have label.
+// Connections is count of all connections
 type mpConsumer struct {
 	sync.RWMutex
-	value map[interface{}]*consumer
+	value       map[interface{}][]*consumer
+	streams     map[string]map[*consumer]struct{}
+	labels      map[string]map[string]map[*consumer]struct{}
+	connections int
+}
+
+// each calls function for every connection. Map MUST BE locked
+func (m *mpConsumer) each(f func(*consumer)) {
+	for _, consumers := range m.value {
+		for _, cons := range consumers {
+			f(cons)
+		}
+	}
+}
+
+// A ConsumerOptions represents options of connecting consumer. Streams are
+// names of streams which consumer is subscribed to, consumer is rejected if
+// stream does not exist. If they are not set, streams are taken from query
+// parameter "stream" of request and unknown streams are ignored. Labels are
+// used by EventSelector. Retry is sent to consumer in preamble instead of
+// retry of config. RateLimit is used instead of rate limit of config
+type ConsumerOptions struct {
+	Streams   []string
+	Labels    map[string]string
+	Retry     time.Duration
+	RateLimit *RateLimit
 }
 
 // A SideEventer represents a interface SSE
@@ -32,28 +138,72 @@ type SideEventer interface {
 	HandlerConnectNotify(func(interface{}))
 	HandlerDisconnectNotify(func(interface{}))
 	HandlerReconnectNotify(func(*Reconnect))
+	HandlerConnectionNotify(func(*Connection))
+	HandlerLagNotify(func(*Lag))
+	HandlerBrokerErrorNotify(func(error))
+	HandlerReject(func(http.ResponseWriter, *http.Request, *Rejection))
 	RemoveConsumer(interface{})
 	CountConsumer() int
+	CountConnections() int
+	CountExpired() uint64
 	HandlerHTTP(interface{}, http.ResponseWriter, *http.Request)
+	HandlerHTTPOptions(interface{}, *ConsumerOptions, http.ResponseWriter, *http.Request)
+	ServeHTTP(http.ResponseWriter, *http.Request)
+	CreateStream(string)
+	RemoveStream(string)
 	Close()
-        ConsumerValues() map[interface{}]*consumer
+	Shutdown(context.Context) error
+	ConsumerValues() map[interface{}]*consumer
 }
 
 // A SSE represents a information about consumers. SSE has a map of consumers,
 // the keys of the map are the СID which we can push events to attached clients
 type SSE struct {
 	consumer *mpConsumer
-	closeSSE chan bool
-	event    chan eventer
+	// Last id of connection
+	connID uint64
+	// Retry of preamble is changed by EventRetry, it is read by handlers
+	// concurrently, so it is accessed atomically
+	retry int64
+	// Count events dropped by TTL
+	expired uint64
+	replay  *replayLog
+	event   chan eventer
+	// Closed event channel drops new events
+	eventClose struct {
+		sync.RWMutex
+		close bool
+	}
+	// Dispatched is closed when all events were dispatched
+	dispatched chan struct{}
+	shutdown   struct {
+		sync.Once
+		done chan struct{}
+	}
 	// Informations about situations (optional)
 	handlerConnectNotify    func(interface{})
 	handlerDisconnectNotify func(interface{})
 	handlerReconnectNotify  func(*Reconnect)
-	waitClose               struct {
+	handlerConnectionNotify func(*Connection)
+	handlerLagNotify        func(*Lag)
+	handlerBrokerError      func(error)
+	handlerReject           func(http.ResponseWriter, *http.Request, *Rejection)
+	// Unsubscribe stops receiving events from broker
+	unsubscribe func()
+	lags        struct {
+		sync.Mutex
+		pending []*consumer
+		signal  chan struct{}
+		done    chan struct{}
+	}
+	waitClose struct {
 		sync.Mutex
 		sync.WaitGroup
 		denyConnections  bool
 		countConnections int
+		perIP            map[string]int
+		perIdentity      map[interface{}]int
+		connectRate      *tokenBucket
 	}
 	config Config
 }
@@ -62,67 +212,206 @@ type SSE struct {
 func New(cfg *Config) SideEventer {
 	sse := &SSE{
 		consumer: &mpConsumer{
-			value: make(map[interface{}]*consumer),
+			value:   make(map[interface{}][]*consumer),
+			streams: make(map[string]map[*consumer]struct{}),
+			labels:  make(map[string]map[string]map[*consumer]struct{}),
 		},
-		closeSSE: make(chan bool, 1),
-		event:    make(chan eventer, 50),
-		config:   *cfg,
+		event:      make(chan eventer, 50),
+		dispatched: make(chan struct{}),
+		config:     *cfg,
+	}
+	sse.shutdown.done = make(chan struct{})
+	sse.retry = int64(sse.config.Retry)
+	sse.replay = newReplayLog(&sse.config)
+	if sse.config.Metrics == nil {
+		sse.config.Metrics = nopMetrics{}
+	}
+	sse.lags.signal = make(chan struct{}, 1)
+	sse.lags.done = make(chan struct{})
+	sse.waitClose.perIP = make(map[string]int)
+	sse.waitClose.perIdentity = make(map[interface{}]int)
+	if sse.config.ConnectRate > 0 {
+		sse.waitClose.connectRate = newTokenBucket(sse.config.ConnectRate, sse.config.ConnectBurst)
 	}
 
+	if sse.config.Broker != nil {
+		sse.unsubscribe = sse.config.Broker.Subscribe(sse.receiveMessage)
+	}
 	sse.start()
 	return sse
 }
 
-func  (s *SSE) ConsumerValues() map[interface{}]*consumer {
-	return s.consumer.value
+// ConsumerValues returns the first connection of every consumer
+func (s *SSE) ConsumerValues() map[interface{}]*consumer {
+	s.consumer.RLock()
+	defer s.consumer.RUnlock()
+	values := make(map[interface{}]*consumer, len(s.consumer.value))
+	for cid, consumers := range s.consumer.value {
+		values[cid] = consumers[0]
+	}
+	return values
 }
 
 // receiveEvent waits new events and dispatches them
 func (s *SSE) receiveEvent() {
+	defer close(s.dispatched)
 	for event := range s.event {
-		event.dispatch(s.consumer)
-		if eventRetry, ok := event.(*EventRetry); ok {
-			s.config.Retry = eventRetry.Time
+		if entry, ok := newReplayEntry(event); ok && s.replay != nil {
+			// Event is saved and dispatched under lock, so new consumer gets
+			// it either from replay log or from main queue
+			s.replay.Lock()
+			s.storeRetry(event)
+			start := time.Now()
+			s.replay.push(entry)
+			event.dispatch(s.consumer)
+			s.config.Metrics.Dispatched(time.Since(start))
+			s.replay.Unlock()
+		} else {
+			s.storeRetry(event)
+			start := time.Now()
+			event.dispatch(s.consumer)
+			s.config.Metrics.Dispatched(time.Since(start))
 		}
 	}
 }
 
-// closeWait closes all channel and disconnects all clients
-func (s *SSE) closeWait() {
-	select {
-	case <-s.closeSSE:
-		close(s.closeSSE)
-		close(s.event)
-		s.waitClose.Lock()
-		s.waitClose.denyConnections = true
-		s.waitClose.Unlock()
-		s.consumer.RLock()
-		for _, cons := range s.consumer.value {
-			cons.close()
-		}
-		s.consumer.RUnlock()
+// storeRetry saves retry of EventRetry before dispatching, so consumer which
+// connects during dispatching gets new retry either by preamble or by event
+func (s *SSE) storeRetry(event eventer) {
+	if eventRetry, ok := event.(*EventRetry); ok {
+		atomic.StoreInt64(&s.retry, int64(eventRetry.Time))
+	}
+}
+
+// retryOf returns retry of preamble, retry of options of consumer is preferred
+func (s *SSE) retryOf(opts *ConsumerOptions) time.Duration {
+	if opts != nil && opts.Retry > 0 {
+		return opts.Retry
+	}
+	return time.Duration(atomic.LoadInt64(&s.retry))
+}
+
+// stop denies new connections, dispatches sent events and disconnects all
+// consumers. If drain is true, consumers write their queues before
+// disconnection, otherwise they are disconnected immediately
+func (s *SSE) stop(drain bool) {
+	s.waitClose.Lock()
+	s.waitClose.denyConnections = true
+	s.waitClose.Unlock()
+	if drain {
+		s.SendEvent(&eventShutdown{
+			event: s.config.ShutdownEvent,
+			retry: s.config.ShutdownRetry,
+		})
+	} else {
+		s.closeConsumers()
+	}
+	if s.unsubscribe != nil {
+		s.unsubscribe()
 	}
+	s.eventClose.Lock()
+	s.eventClose.close = true
+	close(s.event)
+	s.eventClose.Unlock()
+	<-s.dispatched
+	// Closed main queue stops consumer after the last queued event
+	s.consumer.Lock()
+	var consumers []*consumer
+	s.consumer.each(func(cons *consumer) {
+		consumers = append(consumers, cons)
+	})
+	for _, cons := range consumers {
+		cons.setReason(DisconnectShutdown)
+		cons.closeRecovery()
+		s.remove(cons)
+	}
+	s.consumer.Unlock()
+	close(s.lags.done)
+	close(s.shutdown.done)
+}
+
+// closeConsumers disconnects all consumers immediately
+func (s *SSE) closeConsumers() {
+	s.consumer.RLock()
+	s.consumer.each(func(cons *consumer) {
+		cons.close(DisconnectShutdown)
+	})
+	s.consumer.RUnlock()
 }
 
 func (s *SSE) start() {
 	go s.receiveEvent()
-	go s.closeWait()
+	go s.notifyLag()
 }
 
-// SendEvent sends event
+// SendEvent sends event, event is dropped if side event is closed. If broker
+// is set, event is published through it and it is dispatched when broker
+// delivers it back. Event is dispatched only to own consumers if publishing
+// failed, error is transferred to HandlerBrokerErrorNotify
 func (s *SSE) SendEvent(event eventer) {
-	s.event <- event
+	if s.config.Broker != nil {
+		if msg, ok := newMessage(event); ok && !s.closed() {
+			err := s.config.Broker.Publish(msg)
+			if err == nil {
+				return
+			}
+			if s.handlerBrokerError != nil {
+				s.handlerBrokerError(err)
+			}
+		}
+	}
+	s.sendLocal(event)
+}
+
+// receiveMessage dispatches event received from broker
+func (s *SSE) receiveMessage(msg *Message) {
+	if event := msg.eventer(); event != nil {
+		s.sendLocal(event)
+	}
+}
+
+// closed checks that side event is closed
+func (s *SSE) closed() bool {
+	s.eventClose.RLock()
+	defer s.eventClose.RUnlock()
+	return s.eventClose.close
 }
 
-// RemoveConsumer removes consumer by СID
+// sendLocal sends event to own consumers
+func (s *SSE) sendLocal(event eventer) {
+	s.eventClose.RLock()
+	defer s.eventClose.RUnlock()
+	if !s.eventClose.close {
+		s.event <- event
+	}
+}
+
+// RemoveConsumer removes all connections of consumer by СID
 func (s *SSE) RemoveConsumer(сid interface{}) {
 	s.consumer.RLock()
-	if cons, ok := s.consumer.value[сid]; ok {
-		cons.close()
+	for _, cons := range s.consumer.value[сid] {
+		cons.close(DisconnectRemoved)
 	}
 	s.consumer.RUnlock()
 }
 
+// CreateStream creates stream, consumers can subscribe to it after creating
+func (s *SSE) CreateStream(name string) {
+	s.consumer.Lock()
+	defer s.consumer.Unlock()
+	if _, ok := s.consumer.streams[name]; !ok {
+		s.consumer.streams[name] = make(map[*consumer]struct{})
+	}
+}
+
+// RemoveStream removes stream. Subscribed consumers stay connected, but they
+// do not get events of stream
+func (s *SSE) RemoveStream(name string) {
+	s.consumer.Lock()
+	delete(s.consumer.streams, name)
+	s.consumer.Unlock()
+}
+
 // HandlerConnectNotify calls function
 func (s *SSE) HandlerConnectNotify(handler func(interface{})) {
 	s.handlerConnectNotify = handler
@@ -134,19 +423,162 @@ func (s *SSE) HandlerReconnectNotify(handler func(*Reconnect)) {
 	s.handlerReconnectNotify = handler
 }
 
+// HandlerConnectionNotify calls function and transfers struct Connection
+// after connection and disconnection of consumer
+func (s *SSE) HandlerConnectionNotify(handler func(*Connection)) {
+	s.handlerConnectionNotify = handler
+}
+
 // HandlerDisconnectNotify calls function
 func (s *SSE) HandlerDisconnectNotify(handler func(interface{})) {
 	s.handlerDisconnectNotify = handler
 }
 
-// add adds new client in map
+// HandlerLagNotify calls function and transfers struct Lag, when event was
+// dropped or consumer was disconnected because of full channel. Lags of
+// consumer are aggregated until function is called
+func (s *SSE) HandlerLagNotify(handler func(*Lag)) {
+	s.handlerLagNotify = handler
+}
+
+// HandlerReject calls function to write response to rejected consumer instead
+// of default response
+func (s *SSE) HandlerReject(handler func(http.ResponseWriter, *http.Request, *Rejection)) {
+	s.handlerReject = handler
+}
+
+// HandlerBrokerErrorNotify calls function, when event was not published
+// through broker
+func (s *SSE) HandlerBrokerErrorNotify(handler func(error)) {
+	s.handlerBrokerError = handler
+}
+
+// lag requests notification about lagging consumer
+func (s *SSE) lag(cons *consumer) {
+	s.lags.Lock()
+	s.lags.pending = append(s.lags.pending, cons)
+	s.lags.Unlock()
+	select {
+	case s.lags.signal <- struct{}{}:
+	default:
+	}
+}
+
+// notifyLag sends notifications about lagging consumers. Notifications are
+// sent from one goroutine, so handler can send events without blocking
+// dispatcher
+func (s *SSE) notifyLag() {
+	for {
+		select {
+		case <-s.lags.signal:
+		case <-s.lags.done:
+			return
+		}
+		s.lags.Lock()
+		pending := s.lags.pending
+		s.lags.pending = nil
+		s.lags.Unlock()
+		for _, cons := range pending {
+			info := cons.takeLag()
+			if s.handlerLagNotify != nil {
+				s.handlerLagNotify(info)
+			}
+		}
+	}
+}
+
+// add adds new connection in map, subscribes it to streams and indexes
+// labels, returns true if it is the first connection of consumer
 // unlocks map
-func (s *SSE) add(ctx context.Context) {
-	s.consumer.value[ctx.Value(consumerKey)] = ctx.Value(consumerValue).(*consumer)
+func (s *SSE) add(cons *consumer, streams []string) bool {
+	first := len(s.consumer.value[cons.cid]) == 0
+	s.consumer.value[cons.cid] = append(s.consumer.value[cons.cid], cons)
+	s.consumer.connections++
+	for _, name := range streams {
+		s.consumer.streams[name][cons] = struct{}{}
+	}
+	s.consumer.indexLabels(cons)
 	s.consumer.Unlock()
-	if s.handlerConnectNotify != nil {
-		s.handlerConnectNotify(ctx.Value(consumerKey))
+	return first
+}
+
+// remove removes connection from map and streams, saves in connection that
+// it was the last connection of consumer
+// map MUST BE locked
+func (s *SSE) remove(cons *consumer) {
+	consumers := s.consumer.value[cons.cid]
+	for i, c := range consumers {
+		if c != cons {
+			continue
+		}
+		cons.mainQueue.close()
+		consumers = append(consumers[:i:i], consumers[i+1:]...)
+		if len(consumers) == 0 {
+			delete(s.consumer.value, cons.cid)
+			cons.last = true
+		} else {
+			s.consumer.value[cons.cid] = consumers
+		}
+		s.consumer.connections--
+		s.consumer.unindexLabels(cons)
+		for _, subscribers := range s.consumer.streams {
+			delete(subscribers, cons)
+		}
+		return
+	}
+}
+
+// streams returns names of streams which consumer is subscribed to, strict
+// is true if streams must exist
+func (s *SSE) streams(opts *ConsumerOptions, r *http.Request) ([]string, bool) {
+	if opts != nil && len(opts.Streams) != 0 {
+		return opts.Streams, true
+	}
+	var streams []string
+	for _, value := range r.URL.Query()["stream"] {
+		for _, name := range strings.Split(value, ",") {
+			if name != "" {
+				streams = append(streams, name)
+			}
+		}
 	}
+	return streams, false
+}
+
+// encoding returns negotiated compression of stream
+func (s *SSE) encoding(r *http.Request) string {
+	if !s.config.Compression {
+		return ""
+	}
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"))
+}
+
+// rateLimit returns rate limit of consumer, rate limit of options of consumer
+// is preferred
+func (s *SSE) rateLimit(opts *ConsumerOptions) *RateLimit {
+	if opts != nil && opts.RateLimit != nil {
+		return opts.RateLimit
+	}
+	return s.config.RateLimit
+}
+
+// queueSize returns size of queues of consumer
+func (s *SSE) queueSize() int {
+	if s.config.QueueSize > 0 {
+		return s.config.QueueSize
+	}
+	return 50
+}
+
+// batchBytes returns limit of batch, zero disables batching
+func (s *SSE) batchBytes() int {
+	if s.config.BatchBytes > 0 {
+		return s.config.BatchBytes
+	}
+	if s.config.BatchLatency > 0 {
+		return 64 << 10
+	}
+	return 0
 }
 
 // CountConsumer returns count clients, include active and noactive.
@@ -158,40 +590,172 @@ func (s *SSE) CountConsumer() int {
 	return len(s.consumer.value)
 }
 
+// CountConnections returns count connections of all clients, it is greater
+// than CountConsumer if clients have many connections
+func (s *SSE) CountConnections() int {
+	s.consumer.RLock()
+	defer s.consumer.RUnlock()
+	return s.consumer.connections
+}
+
+// CountExpired returns count events which were dropped by TTL
+func (s *SSE) CountExpired() uint64 {
+	return atomic.LoadUint64(&s.expired)
+}
+
+// expire counts events of consumer which were dropped by TTL
+func (s *SSE) expire(cons *consumer, count int) {
+	atomic.AddUint64(&s.expired, uint64(count))
+	s.config.Metrics.Expired(cons.cid, count)
+}
+
 // HandlerHTTP handles new connections
 // Creates new context information about client.
 func (s *SSE) HandlerHTTP(cid interface{}, w http.ResponseWriter, r *http.Request) {
-	// Check wait close side event
-	s.waitClose.Lock()
+	s.HandlerHTTPOptions(cid, nil, w, r)
+}
+
+// ServeHTTP handles new connections, consumer is authenticated by
+// Authenticator, which MUST BE set in config
+func (s *SSE) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.Authenticator == nil {
+		s.reject(w, r, &Rejection{Reason: RejectInternal, Code: http.StatusInternalServerError})
+		return
+	}
+	s.HandlerHTTPOptions(nil, nil, w, r)
+}
+
+// HandlerHTTPOptions handles new connections with options of consumer
+func (s *SSE) HandlerHTTPOptions(cid interface{}, opts *ConsumerOptions, w http.ResponseWriter, r *http.Request) {
+	var identity interface{}
+	if s.config.Authenticator != nil {
+		var err error
+		if cid, identity, err = s.config.Authenticator(r); err != nil {
+			rej := &Rejection{Reason: RejectUnauthorized, Code: authStatus(err), Err: err}
+			if errors.Is(err, ErrStopReconnect) {
+				rej.Reason, rej.Code = RejectStopReconnect, http.StatusNoContent
+			}
+			s.reject(w, r, rej)
+			return
+		}
+	}
+	requested, strict := s.streams(opts, r)
+	var labels map[string]string
+	if opts != nil {
+		labels = opts.Labels
+	}
 	// Make sure that the writer support flushing
-	if _, ok := w.(http.Flusher); !ok || s.waitClose.denyConnections {
-		s.waitClose.Unlock()
-		http.Error(w, "", http.StatusInternalServerError)
+	if !canFlush(w) {
+		s.reject(w, r, &Rejection{CID: cid, Reason: RejectInternal, Code: http.StatusInternalServerError})
 		return
 	}
+	// Check wait close side event and limits
+	s.waitClose.Lock()
+	release, rej := s.admit(cid, identity, r)
 	s.waitClose.Unlock()
+	if rej != nil {
+		rej.CID = cid
+		s.reject(w, r, rej)
+		return
+	}
+	defer release()
+	// Locks replay log until consumer will be added in map, so every event
+	// gets to consumer either from replay log or from main queue
+	var missed []*frame
+	replayed := false
+	lockedReplay := s.replay != nil && r.Header.Get("Last-Event-ID") != ""
+	if lockedReplay {
+		s.replay.Lock()
+	}
 	// Locks main map, avoiding situating with connecting simillar id clients.
 	// IT REQUIRES CORRECTION
 	s.consumer.Lock()
-	if _, ok := s.consumer.value[cid]; ok {
+	// Side event could be closed while waiting lock
+	s.waitClose.Lock()
+	deny := s.waitClose.denyConnections
+	s.waitClose.Unlock()
+	if _, ok := s.consumer.value[cid]; (ok && !s.config.MultipleConnections) || deny {
 		s.consumer.Unlock()
-		http.Error(w, "", http.StatusInternalServerError)
+		if lockedReplay {
+			s.replay.Unlock()
+		}
+		rej := &Rejection{CID: cid, Reason: RejectDuplicate, Code: http.StatusConflict}
+		if deny {
+			rej.Reason, rej.Code, rej.RetryAfter = RejectShutdown, http.StatusServiceUnavailable, s.retryAfter()
+		}
+		s.reject(w, r, rej)
 		return
 	}
-	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), consumerKey, cid))
+	var streams []string
+	for _, name := range requested {
+		if _, ok := s.consumer.streams[name]; ok {
+			streams = append(streams, name)
+		} else if strict {
+			s.consumer.Unlock()
+			if lockedReplay {
+				s.replay.Unlock()
+			}
+			s.reject(w, r, &Rejection{CID: cid, Reason: RejectStreamNotFound, Code: http.StatusNotFound})
+			return
+		}
+	}
+	if lockedReplay {
+		missed, replayed = s.replay.since(r.Header.Get("Last-Event-ID"), cid, streams, labels)
+	}
+	// Consumer is disconnected when request is cancelled
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), consumerKey, cid))
 	consumer := newConsumer(&configConsumer{
-		w:      w,
-		retry:  &s.config.Retry,
-		header: s.config.Header,
+		w:               w,
+		retry:           s.retryOf(opts),
+		padding:         s.config.Padding,
+		header:          s.config.Header,
+		overflow:        s.config.Overflow,
+		overflowTimeout: s.config.OverflowTimeout,
+		heartbeat:       s.config.Heartbeat,
+		writeTimeout:    s.config.WriteTimeout,
+		lag:             s.lag,
+		metrics:         s.config.Metrics,
+		encoding:        s.encoding(r),
+		batchLatency:    s.config.BatchLatency,
+		batchBytes:      s.batchBytes(),
+		ttl:             s.config.EventTTL,
+		expired:         s.expire,
+		queueSize:       s.queueSize(),
+		rateLimit:       s.rateLimit(opts),
+		clock:           s.config.Clock,
 	})
+	consumer.cid, consumer.id = cid, atomic.AddUint64(&s.connID, 1)
+	consumer.identity = identity
+	consumer.labels = labels
 	ctx = context.WithValue(ctx, consumerValue, consumer)
-	go consumer.serve(ctx, cancel)
-	s.add(ctx)
+	consumer.context, consumer.cancelContext = ctx, cancel
+	go consumer.serve()
+	first := s.add(consumer, streams)
+	if lockedReplay {
+		s.replay.Unlock()
+	}
+	s.config.Metrics.Connected(cid, r.Header.Get("Last-Event-ID") != "")
+	if s.handlerConnectNotify != nil && first {
+		s.handlerConnectNotify(cid)
+	}
+	if s.handlerConnectionNotify != nil {
+		s.handlerConnectionNotify(&Connection{
+			CID:       cid,
+			ConnID:    consumer.id,
+			Identity:  identity,
+			Connected: true,
+			First:     first,
+		})
+	}
 	// Check recconnect consumer
 	// Create new context with id consumer
 	r = r.WithContext(context.WithValue(r.Context(), consumerKey, cid))
 	if info, ok := consumer.recovery(r); ok {
-		if s.handlerReconnectNotify != nil {
+		// Lost events are sent from replay log, user handler is called only
+		// if Last-Event-ID is older than log
+		if replayed {
+			consumer.replay(missed)
+		} else if s.handlerReconnectNotify != nil {
 			s.handlerReconnectNotify(info)
 		} else {
 			consumer.closeRecovery()
@@ -201,14 +765,23 @@ func (s *SSE) HandlerHTTP(cid interface{}, w http.ResponseWriter, r *http.Reques
 	<-ctx.Done()
 	// Remove consumer from map
 	s.consumer.Lock()
-	if consumer, ok := s.consumer.value[ctx.Value(consumerKey)]; ok {
-		close(consumer.mainChannel)
-		delete(s.consumer.value, ctx.Value(consumerKey))
-	}
+	s.remove(consumer)
 	s.consumer.Unlock()
+	// Writer MUST NOT be used after handler returns
+	<-consumer.done
+	s.config.Metrics.Disconnected(cid, consumer.reason())
 	// Sends notification about disconnected
-	if s.handlerDisconnectNotify != nil {
-		s.handlerDisconnectNotify(ctx.Value(consumerKey))
+	if s.handlerDisconnectNotify != nil && consumer.last {
+		s.handlerDisconnectNotify(cid)
+	}
+	if s.handlerConnectionNotify != nil {
+		s.handlerConnectionNotify(&Connection{
+			CID:      cid,
+			ConnID:   consumer.id,
+			Identity: identity,
+			Last:     consumer.last,
+			Reason:   consumer.reason(),
+		})
 	}
 	/*
 		Don't close the connection, instead loop 10 times,
@@ -224,7 +797,35 @@ func (s *SSE) HandlerHTTP(cid interface{}, w http.ResponseWriter, r *http.Reques
 	*/
 }
 
-// Close closes side event: close all connections, close all channel
+// Close closes side event: close all connections, close all channel.
+// It can be called many times and after Shutdown to disconnect consumers
+// immediately
 func (s *SSE) Close() {
-	s.closeSSE <- true
+	s.shutdown.Do(func() {
+		s.stop(false)
+	})
+	s.closeConsumers()
+}
+
+// Shutdown closes side event gracefully: new connections are denied, shutdown
+// event is sent, consumers write queued events and are disconnected. It waits
+// until all handlers return or ctx is done, then consumers are disconnected
+// immediately and error of ctx is returned. It can be called many times
+func (s *SSE) Shutdown(ctx context.Context) error {
+	s.shutdown.Do(func() {
+		go s.stop(true)
+	})
+	wait := make(chan struct{})
+	go func() {
+		<-s.shutdown.done
+		s.waitClose.Wait()
+		close(wait)
+	}()
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		s.closeConsumers()
+		return ctx.Err()
+	}
 }
@@ -1,6 +1,7 @@
 package sse
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
@@ -38,6 +39,8 @@ func tinit(t *testing.T) (SideEventer, *httptest.Server, net.Conn) {
 	} else {
 		time.Sleep(100 * time.Millisecond)
 		conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+		// Headers and preamble are sent at once
+		expectResponse(t, conn, "retry:15000\n\n")
 		return serveSSE, server, conn
 	}
 	return nil, nil, nil
@@ -72,7 +75,7 @@ func TestSendEventWithNotification(t *testing.T) {
 			Value: "testMessage",
 		},
 	})
-	expectResponse(t, conn, "event:notification1\ndata:testMessage\nretry:15000\n\n")
+	expectResponse(t, conn, "event:notification1\ndata:testMessage\n\n")
 	serveSSE.Close()
 }
 
@@ -89,7 +92,7 @@ func TestSendEventWithID(t *testing.T) {
 			ID: "11",
 		})
 	}()
-	expectResponse(t, conn, "data:testMessage\nid:11\nretry:15000\n\n")
+	expectResponse(t, conn, "data:testMessage\nid:11\n\n")
 	serveSSE.Close()
 }
 
@@ -100,10 +103,14 @@ func TestSendEventFirstRetry(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	serveSSE.SendEvent(&Event{
 		Data: &DataEvent{
-			Value: "testMessage",
+			Value: "retry",
 		},
 	})
-	expectResponse(t, conn, "data:testMessage\nretry:15000\n\n")
+	// Retry is sent by preamble, event is not changed
+	resp := read(t, conn)
+	if !strings.Contains(string(resp), "data:retry\n\n") || strings.Contains(string(resp), "retry:") {
+		t.Errorf("expected: data:retry\ngot:\n%s\n", resp)
+	}
 	serveSSE.Close()
 }
 
@@ -118,7 +125,7 @@ func TestRemoveNewline(t *testing.T) {
 		},
 		ID: "1\n1",
 	})
-	expectResponse(t, conn, "data:testMessage\nid:11\nretry:15000\n\n")
+	expectResponse(t, conn, "data:testMessage\nid:11\n\n")
 	serveSSE.SendEvent(&Event{
 		Data: &DataEvent{
 			Value: "testMessage",
@@ -138,15 +145,40 @@ func TestRemoveNewline(t *testing.T) {
 }
 
 func TestCustomHeaderSSE(t *testing.T) {
-	serveSSE, server, conn := tinit(t)
-	defer server.Close()
-	time.Sleep(100 * time.Millisecond)
-	serveSSE.SendEvent(&Event{
-		Data: &DataEvent{
-			Value: "testMessage",
+	serveSSE := New(&Config{
+		Header: map[string]string{
+			"Access-Control-Allow-Origin": "*",
 		},
+		Retry: time.Second * 15,
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	// Headers are flushed with preamble before the first event
+	resp := read(t, conn)
+	for _, expecting := range []string{"Access-Control-Allow-Origin: *\r\n", "X-Accel-Buffering: no\r\n", "retry:15000\n\n"} {
+		if !strings.Contains(string(resp), expecting) {
+			t.Errorf("expected:\n%s\ngot:\n%s\n", expecting, resp)
+		}
+	}
+	serveSSE.Close()
+}
+
+func TestPadding(t *testing.T) {
+	serveSSE := New(&Config{
+		Padding: 16,
 	})
-	expectResponse(t, conn, "Access-Control-Allow-Origin: *\r\n")
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	resp := read(t, conn)
+	if !strings.Contains(string(resp), ":"+strings.Repeat(" ", 16)+"\n\n") || strings.Contains(string(resp), "retry:") {
+		t.Errorf("expected padding without retry\ngot:\n%q\n", resp)
+	}
 	serveSSE.Close()
 }
 
@@ -158,20 +190,21 @@ func TestManyEvents(t *testing.T) {
 	conn2, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
 	conn1.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
 	conn2.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
-	time.Sleep(100 * time.Millisecond)
+	expectResponse(t, conn1, "retry:15000\n\n")
+	expectResponse(t, conn2, "retry:15000\n\n")
 	serveSSE.SendEvent(&Event{
 		Data: &DataEvent{
 			Value: "testMessage",
 		},
 	})
-	expectResponse(t, conn1, "data:testMessage\nretry:15000\n\n")
-	expectResponse(t, conn2, "data:testMessage\nretry:15000\n\n")
+	expectResponse(t, conn1, "data:testMessage\n\n")
+	expectResponse(t, conn2, "data:testMessage\n\n")
 	conn1.Close()
 	conn2.Close()
 	conn, _ = net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
 	defer conn.Close()
 	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
-	time.Sleep(time.Second)
+	expectResponse(t, conn, "retry:15000\n\n")
 	for count := 1; count <= 10; count++ {
 		t.Logf("send message 'testMessage%d'", count)
 		serveSSE.SendEvent(&Event{
@@ -265,8 +298,9 @@ func TestSendEventOnly(t *testing.T) {
 	time.Sleep(time.Second)
 	conn2, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
 	conn1.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
-	time.Sleep(time.Second)
+	expectResponse(t, conn1, "retry:3000\n\n")
 	conn2.Write([]byte("GET / HTTP/1.1\nHost: fo1\n\n"))
+	expectResponse(t, conn2, "retry:3000\n\n")
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -391,8 +425,9 @@ func TestSendEventExcept(t *testing.T) {
 	time.Sleep(time.Second)
 	conn2, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
 	conn1.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
-	time.Sleep(100 * time.Millisecond)
+	expectResponse(t, conn1, "retry:3000\n\n")
 	conn2.Write([]byte("GET / HTTP/1.1\nHost: fo1\n\n"))
+	expectResponse(t, conn2, "retry:3000\n\n")
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -440,7 +475,7 @@ func TestSendEventNewLine(t *testing.T) {
 			Value: "testMessage1\ntestMessage2",
 		},
 	})
-	expectResponse(t, conn, "data:testMessage1\ndata:testMessage2\nretry:15000\n\n")
+	expectResponse(t, conn, "data:testMessage1\ndata:testMessage2\n\n")
 	serveSSE.Close()
 }
 
@@ -455,7 +490,7 @@ func TestSendEventDisabledFormatting(t *testing.T) {
 			DisabledFormatting: true,
 		},
 	})
-	expectResponse(t, conn, "data:testMessage1\ntestMessage2\nretry:15000\n\n")
+	expectResponse(t, conn, "data:testMessage1\ntestMessage2\n\n")
 	serveSSE.Close()
 }
 
@@ -470,13 +505,77 @@ func TestSendEventRetry(t *testing.T) {
 	conn.Close()
 	conn1, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
 	conn1.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	expectResponse(t, conn1, "retry:4000\n\n")
+	serveSSE.SendEvent(&Event{
+		Data: &DataEvent{
+			Value: "testMessage",
+		},
+	})
+	expectResponse(t, conn1, "data:testMessage\n\n")
+	serveSSE.Close()
+}
+
+func TestSendEventWithRetry(t *testing.T) {
+	serveSSE, server, conn := tinit(t)
+	defer server.Close()
+	defer conn.Close()
 	time.Sleep(100 * time.Millisecond)
 	serveSSE.SendEvent(&Event{
 		Data: &DataEvent{
 			Value: "testMessage",
 		},
+		ID:    "1",
+		Retry: time.Second * 5,
 	})
-	expectResponse(t, conn1, "data:testMessage\nretry:4000\n\n")
+	expectResponse(t, conn, "data:testMessage\nid:1\nretry:5000\n\n")
+	serveSSE.Close()
+}
+
+func TestSendEventComment(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry: time.Second * 3,
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn1 := connectConsumer(t, serveSSE, server, "/", 1)
+	defer conn1.Close()
+	expectResponse(t, conn1, "retry:3000\n\n")
+	conn2 := connectConsumer(t, serveSSE, server, "/", 2)
+	defer conn2.Close()
+	expectResponse(t, conn2, "retry:3000\n\n")
+	serveSSE.SendEvent(&EventComment{
+		Comment: "first\nsecond",
+		CID:     []interface{}{1},
+		Except:  true,
+	})
+	serveSSE.SendEvent(&EventComment{
+		Comment: "all",
+	})
+	expectResponse(t, conn1, ": all\n")
+	resp := read(t, conn2)
+	if !strings.Contains(string(resp), ": first\n: second\n") {
+		t.Errorf("expected: comment\ngot:\n%s\n", resp)
+	}
+	serveSSE.Close()
+}
+
+func TestConsumerRetry(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry: time.Second * 3,
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveSSE.HandlerHTTPOptions(1, &ConsumerOptions{Retry: time.Second * 30}, w, r)
+	}))
+	defer server.Close()
+	conn := connectConsumer(t, serveSSE, server, "/", 1)
+	defer conn.Close()
+	expectResponse(t, conn, "retry:30000\n\n")
+	serveSSE.SendEvent(&EventOnly{
+		CID:   []interface{}{1},
+		Data:  &DataEvent{Value: "testMessage"},
+		Retry: time.Minute,
+	})
+	expectResponse(t, conn, "data:testMessage\nretry:60000\n\n")
 	serveSSE.Close()
 }
 
@@ -505,3 +604,472 @@ func TestIdenticalCID(t *testing.T) {
 	}
 	serveSSE.Close()
 }
+
+func TestReplayLastEventID(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:      time.Second * 3,
+		ReplaySize: 2,
+	})
+	reconnect := make(chan string, 1)
+	serveSSE.HandlerReconnectNotify(func(rec *Reconnect) {
+		reconnect <- rec.ID
+		rec.StopRecovery()
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	for count := 1; count <= 3; count++ {
+		serveSSE.SendEvent(&Event{
+			Data: &DataEvent{
+				Value: "testMessage" + strconv.Itoa(count),
+			},
+			ID: strconv.Itoa(count),
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\nLast-Event-ID: 2\n\n"))
+	expectResponse(t, conn, "data:testMessage3\nid:3\n")
+	select {
+	case id := <-reconnect:
+		t.Errorf("unexpected reconnect notify with id %s", id)
+	default:
+	}
+	// Event with ID 1 was removed from replay log
+	conn1, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn1.Close()
+	conn1.Write([]byte("GET / HTTP/1.1\nHost: foo\nLast-Event-ID: 1\n\n"))
+	select {
+	case id := <-reconnect:
+		if id != "1" {
+			t.Errorf("expected: 1\ngot: %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("reconnect notify was not called")
+	}
+	serveSSE.Close()
+}
+
+func TestSendEventStream(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry: time.Second * 3,
+	})
+	serveSSE.CreateStream("news")
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn1, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn1.Close()
+	conn1.Write([]byte("GET /?stream=news HTTP/1.1\nHost: foo\n\n"))
+	conn2, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn2.Close()
+	conn2.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	expectResponse(t, conn1, "retry:3000\n\n")
+	expectResponse(t, conn2, "retry:3000\n\n")
+	serveSSE.SendEvent(&EventStream{
+		Stream: "news",
+		Data: &DataEvent{
+			Value: "testNews",
+		},
+	})
+	expectResponse(t, conn1, "data:testNews\n")
+	serveSSE.SendEvent(&Event{
+		Data: &DataEvent{
+			Value: "testMessage",
+		},
+	})
+	resp := read(t, conn2)
+	if strings.Contains(string(resp), "testNews") || !strings.Contains(string(resp), "data:testMessage\n") {
+		t.Errorf("expected only testMessage\ngot:\n%s\n", resp)
+	}
+	// Unknown streams from query are ignored
+	conn3, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn3.Close()
+	conn3.Write([]byte("GET /?stream=unknown HTTP/1.1\nHost: foo\n\n"))
+	time.Sleep(100 * time.Millisecond)
+	serveSSE.SendEvent(&Event{
+		Data: &DataEvent{
+			Value: "testMessage",
+		},
+	})
+	expectResponse(t, conn3, "200 OK")
+	serveSSE.Close()
+}
+
+func TestStreamNotFound(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry: time.Second * 3,
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveSSE.HandlerHTTPOptions(1, &ConsumerOptions{
+			Streams: []string{"unknown"},
+		}, w, r)
+	}))
+	defer server.Close()
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	expectResponse(t, conn, "404 Not Found")
+	serveSSE.Close()
+}
+
+func TestEventTTL(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	serveSSE := New(&Config{
+		Retry:      time.Second * 3,
+		ReplaySize: 10,
+		EventTTL:   50 * time.Millisecond,
+		Metrics:    metrics,
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "last"}, ID: "0"})
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "stale"}, ID: "1"})
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "long"}, ID: "2", TTL: time.Hour})
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "stale"}, ID: "3"})
+	time.Sleep(100 * time.Millisecond)
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "fresh"}, ID: "4"})
+	time.Sleep(10 * time.Millisecond)
+	// Replayed events are expired in recovery channel
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\nLast-Event-ID: 0\n\n"))
+	resp := readUntil(t, conn, "data:fresh\n")
+	if strings.Contains(resp, "stale") || !strings.Contains(resp, "data:long\nid:2\n") {
+		t.Errorf("unexpected events:\n%s", resp)
+	}
+	if serveSSE.CountExpired() != 2 {
+		t.Errorf("expected: 2 expired\ngot: %d", serveSSE.CountExpired())
+	}
+	if !strings.Contains(metrics.String(), "sse_consumer_events_expired_total{cid=\"1\"} 2\n") {
+		t.Errorf("expired events were not counted:\n%s", metrics.String())
+	}
+	serveSSE.Close()
+}
+
+func TestReplayStream(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:      time.Second * 3,
+		ReplaySize: 10,
+	})
+	serveSSE.CreateStream("news")
+	serveSSE.CreateStream("sport")
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	for count, name := range []string{"news", "sport", "news"} {
+		serveSSE.SendEvent(&EventStream{
+			Stream: name,
+			Data: &DataEvent{
+				Value: "testMessage" + name + strconv.Itoa(count),
+			},
+			ID: strconv.Itoa(count),
+		})
+	}
+	serveSSE.SendEvent(&EventOnly{
+		CID: []interface{}{1},
+		Data: &DataEvent{
+			Value: "testMessageOnly",
+		},
+		ID: "only",
+	})
+	time.Sleep(100 * time.Millisecond)
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET /?stream=news HTTP/1.1\nHost: foo\nLast-Event-ID: 0\n\n"))
+	time.Sleep(100 * time.Millisecond)
+	resp := string(read(t, conn))
+	if !strings.Contains(resp, "data:testMessagenews2\nid:2\n") || !strings.Contains(resp, "testMessageOnly") ||
+		strings.Contains(resp, "testMessagesport") {
+		t.Errorf("expected events of stream news and event only\ngot:\n%s\n", resp)
+	}
+	serveSSE.Close()
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:    time.Second * 3,
+		Overflow: OverflowDisconnect,
+	})
+	lag := make(chan *Lag, 1)
+	serveSSE.HandlerLagNotify(func(info *Lag) {
+		select {
+		case lag <- info:
+		default:
+		}
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	// Consumer does not read events
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	time.Sleep(100 * time.Millisecond)
+	value := strings.Repeat("x", 64*1024)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for count := 1; count <= 500; count++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			serveSSE.SendEvent(&Event{
+				Data: &DataEvent{
+					Value: value,
+				},
+			})
+		}
+	}()
+	select {
+	case info := <-lag:
+		if !info.Evicted || info.Policy != OverflowDisconnect {
+			t.Errorf("expected evicted consumer\ngot: %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lag notify was not called")
+	}
+	close(done)
+	wg.Wait()
+	serveSSE.Close()
+}
+
+func TestHeartbeat(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:     time.Second * 3,
+		Heartbeat: 100 * time.Millisecond,
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	time.Sleep(300 * time.Millisecond)
+	expectResponse(t, conn, ": ping\n")
+	serveSSE.Close()
+}
+
+func TestReplayMaxAge(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:        time.Second * 3,
+		ReplayMaxAge: 50 * time.Millisecond,
+	})
+	reconnect := make(chan string, 1)
+	serveSSE.HandlerReconnectNotify(func(rec *Reconnect) {
+		reconnect <- rec.ID
+		rec.StopRecovery()
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	for count := 1; count <= 2; count++ {
+		serveSSE.SendEvent(&Event{
+			Data: &DataEvent{
+				Value: "testMessage" + strconv.Itoa(count),
+			},
+			ID: strconv.Itoa(count),
+		})
+	}
+	// Events are expired from replay log
+	time.Sleep(100 * time.Millisecond)
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\nLast-Event-ID: 1\n\n"))
+	select {
+	case id := <-reconnect:
+		if id != "1" {
+			t.Errorf("expected: 1\ngot: %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("reconnect notify was not called")
+	}
+	serveSSE.Close()
+}
+
+func TestHeartbeatDisconnect(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:     time.Second * 3,
+		Heartbeat: 50 * time.Millisecond,
+	})
+	disconnected := make(chan interface{}, 1)
+	serveSSE.HandlerDisconnectNotify(func(id interface{}) {
+		disconnected <- id
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	time.Sleep(100 * time.Millisecond)
+	if serveSSE.CountConsumer() != 1 {
+		t.Errorf("expect: 1\ngot: %d", serveSSE.CountConsumer())
+	}
+	conn.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("consumer was not disconnected")
+	}
+	if serveSSE.CountConsumer() != 0 {
+		t.Errorf("expect: 0\ngot: %d", serveSSE.CountConsumer())
+	}
+	serveSSE.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry: time.Second * 3,
+		ShutdownEvent: &Event{
+			Event: "goodbye",
+			Data:  &DataEvent{Value: "bye"},
+		},
+		ShutdownRetry: 10 * time.Second,
+	})
+	disconnected := make(chan interface{}, 1)
+	serveSSE.HandlerDisconnectNotify(func(id interface{}) {
+		disconnected <- id
+	})
+	server := httptest.NewServer(http.HandlerFunc(makeHandler(serveSSE)))
+	defer server.Close()
+	conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\nHost: foo\n\n"))
+	time.Sleep(100 * time.Millisecond)
+	for count := 1; count <= 20; count++ {
+		serveSSE.SendEvent(&Event{
+			Data: &DataEvent{
+				Value: "testMessage" + strconv.Itoa(count),
+			},
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := serveSSE.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Handler has returned before Shutdown
+	select {
+	case <-disconnected:
+	default:
+		t.Error("consumer was not disconnected")
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	resp, _ := io.ReadAll(conn)
+	for _, expecting := range []string{"data:testMessage20\n", "retry:10000\n", "event:goodbye\ndata:bye\n"} {
+		if !strings.Contains(string(resp), expecting) {
+			t.Errorf("expected:\n%s\ngot:\n%s\n", expecting, resp)
+		}
+	}
+	// Side event is closed, new consumers are denied
+	resp2, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode == http.StatusOK {
+		t.Errorf("expected rejection\ngot: %d", resp2.StatusCode)
+	}
+	if err := serveSSE.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	serveSSE, server, conn := tinit(t)
+	defer server.Close()
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		serveSSE.Close()
+		serveSSE.Close()
+		// Events after closing are dropped
+		serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "testMessage"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close is blocked")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := serveSSE.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultipleConnections(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:               time.Second * 3,
+		MultipleConnections: true,
+	})
+	connections := make(chan *Connection, 10)
+	serveSSE.HandlerConnectionNotify(func(conn *Connection) {
+		connections <- conn
+	})
+	disconnected := make(chan interface{}, 10)
+	serveSSE.HandlerDisconnectNotify(func(id interface{}) {
+		disconnected <- id
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveSSE.HandlerHTTP(r.URL.Query().Get("cid"), w, r)
+	}))
+	defer server.Close()
+	var conns []net.Conn
+	var ids []uint64
+	for _, cid := range []string{"a", "a", "b"} {
+		conn, _ := net.Dial("tcp", strings.Replace(server.URL, "http://", "", 1))
+		defer conn.Close()
+		conn.Write([]byte("GET /?cid=" + cid + " HTTP/1.1\nHost: foo\n\n"))
+		conns = append(conns, conn)
+		select {
+		case info := <-connections:
+			if info.First != (len(conns) != 2) {
+				t.Errorf("connection %d unexpected first: %t", len(conns), info.First)
+			}
+			ids = append(ids, info.ConnID)
+		case <-time.After(time.Second):
+			t.Fatal("connection notify was not called")
+		}
+	}
+	if serveSSE.CountConsumer() != 2 || serveSSE.CountConnections() != 3 {
+		t.Errorf("expect: 2 consumers, 3 connections\ngot: %d, %d", serveSSE.CountConsumer(), serveSSE.CountConnections())
+	}
+	serveSSE.SendEvent(&EventOnly{
+		CID:  []interface{}{"a"},
+		Data: &DataEvent{Value: "onlyA"},
+	})
+	serveSSE.SendEvent(&EventOnly{
+		CID:    []interface{}{"a"},
+		ConnID: ids[1],
+		Data:   &DataEvent{Value: "secondA"},
+	})
+	serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "all"}})
+	for i, expected := range []string{"onlyA", "onlyA,secondA", ""} {
+		resp := readUntil(t, conns[i], "data:all\n")
+		for _, value := range []string{"onlyA", "secondA"} {
+			if strings.Contains(resp, "data:"+value+"\n") != strings.Contains(expected, value) {
+				t.Errorf("connection %d expected %s\ngot:\n%s", i, expected, resp)
+			}
+		}
+	}
+	for i, last := range []bool{false, true} {
+		conns[i].Close()
+		select {
+		case info := <-connections:
+			if info.Connected || info.Last != last {
+				t.Errorf("disconnection %d unexpected last: %t", i, info.Last)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("connection notify was not called")
+		}
+	}
+	// Disconnect notify is called only for the last connection
+	if len(disconnected) != 1 || <-disconnected != "a" {
+		t.Error("expected one disconnect notify")
+	}
+	if serveSSE.CountConsumer() != 1 || serveSSE.CountConnections() != 1 {
+		t.Errorf("expect: 1 consumer, 1 connection\ngot: %d, %d", serveSSE.CountConsumer(), serveSSE.CountConnections())
+	}
+	serveSSE.Close()
+}
@@ -0,0 +1,143 @@
+package ssetest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/itcomusic/sse"
+)
+
+// A Clock represents a fake clock which implements sse.Clock, time is moved
+// only by Advance. It is set to Config.Clock of side event to control
+// heartbeat and to Client.Clock to control reconnection
+type Clock struct {
+	mx     sync.Mutex
+	now    time.Time
+	timers map[*timer]struct{}
+	// Changed is closed and replaced when timer is started or stopped
+	changed chan struct{}
+}
+
+// A timer represents a timer of fake clock, it is active until it fires or
+// it is stopped
+type timer struct {
+	clock    *Clock
+	c        chan time.Time
+	deadline time.Time
+}
+
+// NewClock creates fake clock with time now
+func NewClock(now time.Time) *Clock {
+	return &Clock{
+		now:     now,
+		timers:  make(map[*timer]struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// Now returns current time of clock
+func (c *Clock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+// NewTimer creates timer which fires when clock is advanced by d
+func (c *Clock) NewTimer(d time.Duration) sse.Timer {
+	t := &timer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves time forward and fires timers which deadline has come
+func (c *Clock) Advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// Timers returns count of active timers
+func (c *Clock) Timers() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return len(c.timers)
+}
+
+// WaitTimers waits until clock has at least n active timers, so Advance
+// fires timers which are started by other goroutines. It returns ErrTimeout
+// if timers were not started before timeout
+func (c *Clock) WaitTimers(n int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		c.mx.Lock()
+		count, changed := len(c.timers), c.changed
+		c.mx.Unlock()
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return ErrTimeout
+		}
+	}
+}
+
+// fire sends time into channels of expired timers. Clock MUST BE locked
+func (c *Clock) fire() {
+	for t := range c.timers {
+		if t.deadline.After(c.now) {
+			continue
+		}
+		delete(c.timers, t)
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+	c.change()
+}
+
+// change wakes up waiters. Clock MUST BE locked
+func (c *Clock) change() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops timer, it returns false if timer has already fired or it was
+// stopped. Not received time is dropped like in time.Timer
+func (t *timer) Stop() bool {
+	t.clock.mx.Lock()
+	defer t.clock.mx.Unlock()
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	t.drain()
+	t.clock.change()
+	return active
+}
+
+// Reset changes timer to fire after d, it returns true if timer was active
+func (t *timer) Reset(d time.Duration) bool {
+	t.clock.mx.Lock()
+	defer t.clock.mx.Unlock()
+	_, active := t.clock.timers[t]
+	t.drain()
+	t.deadline = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	t.clock.fire()
+	return active
+}
+
+// drain drops not received time. Clock MUST BE locked
+func (t *timer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
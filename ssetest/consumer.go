@@ -0,0 +1,196 @@
+package ssetest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/itcomusic/sse"
+)
+
+// ConnectTimeout limits waiting of opening stream by Connect
+var ConnectTimeout = 5 * time.Second
+
+// A Options represents options of fake consumer. CID is passed to
+// HandlerHTTPOptions, Header is added to request, LastEventID is sent by
+// header Last-Event-ID to get replay or recovery, Target is URL of request,
+// default is "/", and Consumer are options of consumer
+type Options struct {
+	CID         interface{}
+	Header      http.Header
+	LastEventID string
+	Target      string
+	Consumer    *sse.ConsumerOptions
+}
+
+// A Consumer represents a fake consumer connected to side event. Handler of
+// side event runs in goroutine until consumer is closed or disconnected by
+// side event
+type Consumer struct {
+	CID     interface{}
+	Writer  *ResponseWriter
+	Request *http.Request
+	done    chan struct{}
+}
+
+// Connect connects fake consumer for every options and waits until their
+// streams are opened. It returns error if consumer was rejected, connected
+// consumers are closed then
+func Connect(side sse.SideEventer, options ...Options) ([]*Consumer, error) {
+	consumers := make([]*Consumer, 0, len(options))
+	for _, opts := range options {
+		cons := connect(side, opts)
+		if err := cons.waitOpen(ConnectTimeout); err != nil {
+			cons.Close()
+			for _, c := range consumers {
+				c.Close()
+			}
+			return nil, err
+		}
+		consumers = append(consumers, cons)
+	}
+	return consumers, nil
+}
+
+// ConnectN connects n fake consumers with CID from 1 to n
+func ConnectN(side sse.SideEventer, n int) ([]*Consumer, error) {
+	options := make([]Options, n)
+	for i := range options {
+		options[i].CID = i + 1
+	}
+	return Connect(side, options...)
+}
+
+// connect starts handler of side event with new request
+func connect(side sse.SideEventer, opts Options) *Consumer {
+	target := opts.Target
+	if target == "" {
+		target = "/"
+	}
+	w := NewResponseWriter(context.Background())
+	r := httptest.NewRequest(http.MethodGet, target, nil).WithContext(w.Context())
+	for name, values := range opts.Header {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	if opts.LastEventID != "" {
+		r.Header.Set("Last-Event-ID", opts.LastEventID)
+	}
+	cons := &Consumer{
+		CID:     opts.CID,
+		Writer:  w,
+		Request: r,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		// Rest of response is written after handler returns like by server
+		defer w.finish()
+		defer close(cons.done)
+		side.HandlerHTTPOptions(opts.CID, opts.Consumer, w, r)
+	}()
+	return cons
+}
+
+// waitOpen waits the first flush, which is preamble of stream, or return of
+// handler which rejected consumer
+func (c *Consumer) waitOpen(timeout time.Duration) error {
+	err := c.Writer.Wait(timeout, func(w *ResponseWriter) bool {
+		return w.Flushes() > 0 || c.finished()
+	})
+	if err != nil {
+		return fmt.Errorf("ssetest: stream of %v was not opened: %w", c.CID, err)
+	}
+	if c.Writer.Flushes() == 0 {
+		return fmt.Errorf("ssetest: consumer %v was rejected with status %d", c.CID, c.Writer.Code())
+	}
+	return nil
+}
+
+// finished checks that handler of side event returned
+func (c *Consumer) finished() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Events returns all received events
+func (c *Consumer) Events() []Event {
+	return c.Writer.Events()
+}
+
+// WaitEvent waits event which is matched, events received before are
+// checked too. It returns ErrTimeout if event was not received before timeout
+func (c *Consumer) WaitEvent(timeout time.Duration, match func(Event) bool) (Event, error) {
+	var found Event
+	err := c.Writer.Wait(timeout, func(w *ResponseWriter) bool {
+		for _, e := range w.Events() {
+			if match(e) {
+				found = e
+				return true
+			}
+		}
+		return false
+	})
+	return found, err
+}
+
+// WaitEvents waits until n events which are matched are received, it returns
+// all matched events
+func (c *Consumer) WaitEvents(timeout time.Duration, n int, match func(Event) bool) ([]Event, error) {
+	var found []Event
+	err := c.Writer.Wait(timeout, func(w *ResponseWriter) bool {
+		found = found[:0]
+		for _, e := range w.Events() {
+			if match(e) {
+				found = append(found, e)
+			}
+		}
+		return len(found) >= n
+	})
+	return found, err
+}
+
+// WaitID waits event with id
+func (c *Consumer) WaitID(timeout time.Duration, id string) (Event, error) {
+	return c.WaitEvent(timeout, func(e Event) bool {
+		return e.ID == id
+	})
+}
+
+// Done returns channel which is closed when handler of side event returned
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes connection and waits until handler of side event returns
+func (c *Consumer) Close() {
+	c.Writer.Close()
+	<-c.done
+}
+
+// Data matches events with data
+func Data(data string) func(Event) bool {
+	return func(e Event) bool {
+		return e.HasData && e.Data == data
+	}
+}
+
+// Name matches events with name
+func Name(name string) func(Event) bool {
+	return func(e Event) bool {
+		return e.Event == name
+	}
+}
+
+// Comment matches comments with text
+func Comment(text string) func(Event) bool {
+	return func(e Event) bool {
+		return e.IsComment() && e.Comment == text
+	}
+}
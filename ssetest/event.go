@@ -0,0 +1,75 @@
+package ssetest
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Event represents a parsed block of stream. Unlike client, every block
+// with fields is returned as is: block with only retry is returned with Retry
+// and comment is returned as separated event with Comment, so preamble and
+// heartbeat can be checked. Data of many lines are joined by line feed
+type Event struct {
+	Event   string
+	Data    string
+	ID      string
+	Retry   time.Duration
+	Comment string
+	// HasData is true if block has field data, even empty
+	HasData bool
+}
+
+// IsComment checks that event is comment
+func (e Event) IsComment() bool {
+	return e.Event == "" && !e.HasData && e.ID == "" && e.Retry == 0
+}
+
+// Parse parses stream into events. Lines can be ended with CRLF, LF or CR,
+// unfinished block at the end of stream is discarded, comment is returned at
+// once because it is not ended by empty line
+func Parse(stream string) []Event {
+	var events []Event
+	var cur Event
+	var data []string
+	var fields bool
+	stream = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(stream)
+	lines := strings.Split(stream, "\n")
+	// The last element is not ended by line feed
+	for _, line := range lines[:len(lines)-1] {
+		if line == "" {
+			if fields {
+				cur.Data = strings.Join(data, "\n")
+				events = append(events, cur)
+			}
+			cur, data, fields = Event{}, nil, false
+			continue
+		}
+		name, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			name, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch name {
+		case "":
+			events = append(events, Event{Comment: value})
+			continue
+		case "event":
+			cur.Event = value
+		case "data":
+			cur.HasData = true
+			data = append(data, value)
+		case "id":
+			cur.ID = value
+		case "retry":
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			cur.Retry = time.Duration(ms) * time.Millisecond
+		default:
+			continue
+		}
+		fields = true
+	}
+	return events
+}
@@ -0,0 +1,173 @@
+package ssetest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itcomusic/sse"
+)
+
+const timeout = 2 * time.Second
+
+func TestParse(t *testing.T) {
+	stream := ":   \nretry:1000\n\nevent:a\ndata:1\ndata:2\nid:7\n\n\n: ping\r\ndata:\r\n\r\nevent:unfinished\n"
+	expected := []Event{
+		{Comment: "  "},
+		{Retry: time.Second},
+		{Event: "a", Data: "1\n2", ID: "7", HasData: true},
+		{Comment: "ping"},
+		{HasData: true},
+	}
+	if events := Parse(stream); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected: %+v\ngot: %+v", expected, events)
+	}
+	if !expected[3].IsComment() || expected[4].IsComment() {
+		t.Error("comment was not recognized")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	s := sse.New(&sse.Config{Retry: time.Second})
+	defer s.Close()
+	consumers, err := ConnectN(s, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CountConsumer() != 2 {
+		t.Fatalf("expected: 2 consumers\ngot: %d", s.CountConsumer())
+	}
+	if events := consumers[0].Events(); !reflect.DeepEqual(events, []Event{{Retry: time.Second}}) {
+		t.Errorf("unexpected preamble: %+v", events)
+	}
+	if consumers[0].Writer.Header().Get("Content-Type") != "text/event-stream" {
+		t.Error("stream was not opened")
+	}
+	s.SendEvent(&sse.EventOnly{CID: []interface{}{2}, Data: &sse.DataEvent{Value: "only"}, ID: "1"})
+	s.SendEvent(&sse.Event{Event: "all", Data: &sse.DataEvent{Value: "all"}, ID: "2"})
+	if _, err := consumers[0].WaitID(timeout, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := consumers[1].WaitEvent(timeout, Data("only")); err != nil || e.ID != "1" {
+		t.Errorf("event was not received: %+v %v", e, err)
+	}
+	if _, err := consumers[0].WaitEvent(0, Data("only")); err != ErrTimeout {
+		t.Error("event was sent to other consumer")
+	}
+	if _, err := Connect(s, Options{CID: 1}); err == nil {
+		t.Error("duplicate consumer was not rejected")
+	}
+	consumers[0].Close()
+	if !consumers[0].Writer.Closed() || s.CountConsumer() != 1 {
+		t.Error("consumer was not disconnected")
+	}
+	s.RemoveConsumer(2)
+	select {
+	case <-consumers[1].Done():
+	case <-time.After(timeout):
+		t.Error("removed consumer was not disconnected")
+	}
+}
+
+func TestConnectOptions(t *testing.T) {
+	s := sse.New(&sse.Config{ReplaySize: 10})
+	defer s.Close()
+	s.CreateStream("news")
+	watcher, err := Connect(s, Options{CID: "watcher", Target: "/?stream=news"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		s.SendEvent(&sse.EventStream{Stream: "news", Data: &sse.DataEvent{Value: id}, ID: id})
+	}
+	if _, err := watcher[0].WaitID(timeout, "3"); err != nil {
+		t.Fatal(err)
+	}
+	consumers, err := Connect(s, Options{
+		CID:         "late",
+		Header:      http.Header{"X-Test": {"1"}},
+		LastEventID: "1",
+		Consumer:    &sse.ConsumerOptions{Streams: []string{"news"}, Retry: 5 * time.Second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumers[0].Request.Header.Get("X-Test") != "1" {
+		t.Error("header was not set")
+	}
+	events, err := consumers[0].WaitEvents(timeout, 2, func(e Event) bool {
+		return e.HasData
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[0].ID != "2" || events[1].ID != "3" {
+		t.Errorf("expected replay of 2 and 3\ngot: %+v", events)
+	}
+	if consumers[0].Events()[0].Retry != 5*time.Second {
+		t.Error("retry of options was not sent")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	s := sse.New(&sse.Config{Heartbeat: time.Minute, Clock: clock})
+	defer s.Close()
+	consumers, err := ConnectN(s, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for count := 1; count <= 2; count++ {
+		if err := clock.WaitTimers(2, timeout); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Minute - time.Second)
+		if clock.Timers() != 2 {
+			t.Fatal("heartbeat fired before interval")
+		}
+		clock.Advance(time.Second)
+		for _, cons := range consumers {
+			if _, err := cons.WaitEvents(timeout, count, Comment("ping")); err != nil {
+				t.Fatalf("heartbeat %d was not sent: %v", count, err)
+			}
+		}
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("retry:10000\ndata:x\n\n"))
+	}))
+	defer server.Close()
+	clock := NewClock(time.Unix(0, 0))
+	client := sse.NewClient(server.URL)
+	client.Clock = clock
+	received := make(chan struct{}, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.SubscribeWithContext(ctx, "", func(msg []byte) {
+		received <- struct{}{}
+	})
+	<-received
+	if err := clock.WaitTimers(1, timeout); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&connections) != 1 {
+		t.Error("client reconnected before retry")
+	}
+	clock.Advance(10 * time.Second)
+	select {
+	case <-received:
+	case <-time.After(timeout):
+		t.Error("client did not reconnect after retry")
+	}
+}
@@ -0,0 +1,183 @@
+// Package ssetest provides utilities for testing of side event without
+// network: in-memory ResponseWriter, fake consumers, parser of written stream
+// and fake clock for heartbeat and reconnection
+package ssetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by writing into closed ResponseWriter
+var ErrClosed = errors.New("ssetest: connection is closed")
+
+// ErrTimeout is returned when waited condition was not met before timeout
+var ErrTimeout = errors.New("ssetest: timeout")
+
+// A ResponseWriter represents an in-memory http.ResponseWriter which
+// implements flushing and close notification. Written data is visible only
+// after flush like on real connection. Close cancels context of request and
+// notifies CloseNotify, so handler of side event disconnects consumer
+type ResponseWriter struct {
+	mx      sync.Mutex
+	header  http.Header
+	code    int
+	pending bytes.Buffer
+	body    bytes.Buffer
+	flushes int
+	closed  bool
+	// Changed is closed and replaced on every flush and close
+	changed chan struct{}
+	notify  chan bool
+	context context.Context
+	cancel  context.CancelFunc
+}
+
+// NewResponseWriter creates new writer, context of request is derived from ctx
+func NewResponseWriter(ctx context.Context) *ResponseWriter {
+	w := &ResponseWriter{
+		header:  make(http.Header),
+		changed: make(chan struct{}),
+		notify:  make(chan bool, 1),
+	}
+	w.context, w.cancel = context.WithCancel(ctx)
+	return w
+}
+
+// Header returns headers of response
+func (w *ResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader saves status code, only the first code is saved
+func (w *ResponseWriter) WriteHeader(code int) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// Write saves data until next flush. It returns ErrClosed after Close
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.pending.Write(p)
+}
+
+// Flush makes written data visible
+func (w *ResponseWriter) Flush() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.closed {
+		return
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.pending.WriteTo(&w.body)
+	w.flushes++
+	w.change()
+}
+
+// finish makes written data visible after handler returned
+func (w *ResponseWriter) finish() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	w.pending.WriteTo(&w.body)
+	w.change()
+}
+
+// CloseNotify returns channel which gets value when writer is closed
+func (w *ResponseWriter) CloseNotify() <-chan bool {
+	return w.notify
+}
+
+// Close closes connection: context of request is cancelled, CloseNotify is
+// notified and not flushed data is lost. It can be called many times
+func (w *ResponseWriter) Close() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.pending.Reset()
+	w.cancel()
+	w.notify <- true
+	w.change()
+}
+
+// change wakes up waiters. Writer MUST BE locked
+func (w *ResponseWriter) change() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// Context returns context of request which is cancelled by Close
+func (w *ResponseWriter) Context() context.Context {
+	return w.context
+}
+
+// Code returns status code, it is zero if nothing has been written
+func (w *ResponseWriter) Code() int {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.code
+}
+
+// Body returns flushed data
+func (w *ResponseWriter) Body() string {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.body.String()
+}
+
+// Flushes returns count of flushes
+func (w *ResponseWriter) Flushes() int {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.flushes
+}
+
+// Closed checks that writer was closed
+func (w *ResponseWriter) Closed() bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.closed
+}
+
+// Events returns parsed events of flushed data
+func (w *ResponseWriter) Events() []Event {
+	return Parse(w.Body())
+}
+
+// Wait waits until condition is true, condition is checked after every flush
+// and close. It returns ErrTimeout if condition is false after timeout
+func (w *ResponseWriter) Wait(timeout time.Duration, cond func(w *ResponseWriter) bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		w.mx.Lock()
+		changed := w.changed
+		w.mx.Unlock()
+		if cond(w) {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package sse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A loggingWriter represents a writer of middleware, which hides methods of
+// wrapped writer except Unwrap
+type loggingWriter struct {
+	w      http.ResponseWriter
+	status int
+}
+
+func (l *loggingWriter) Header() http.Header {
+	return l.w.Header()
+}
+
+func (l *loggingWriter) Write(b []byte) (int, error) {
+	return l.w.Write(b)
+}
+
+func (l *loggingWriter) WriteHeader(status int) {
+	l.status = status
+	l.w.WriteHeader(status)
+}
+
+func (l *loggingWriter) Unwrap() http.ResponseWriter {
+	return l.w
+}
+
+// A plainWriter represents a writer which can not flush
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+// expectStream connects client, checks protocol and events and disconnects
+// client by request context
+func expectStream(t *testing.T, serveSSE SideEventer, client *http.Client, url string, proto int) {
+	disconnected := make(chan interface{}, 1)
+	serveSSE.HandlerDisconnectNotify(func(id interface{}) {
+		disconnected <- id
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		serveSSE.SendEvent(&Event{Data: &DataEvent{Value: "testMessage"}})
+	}()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != proto {
+		t.Errorf("expected: HTTP/%d\ngot: %s", proto, resp.Proto)
+	}
+	event, err := NewDecoder(resp.Body).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Data.Value != "testMessage" {
+		t.Errorf("expected: testMessage\ngot: %s", event.Data.Value)
+	}
+	cancel()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("consumer was not disconnected")
+	}
+	if serveSSE.CountConsumer() != 0 {
+		t.Errorf("expect: 0\ngot: %d", serveSSE.CountConsumer())
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	serveSSE := New(&Config{Retry: time.Second * 3})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(makeHandler(serveSSE)))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	expectStream(t, serveSSE, server.Client(), server.URL, 2)
+	serveSSE.Close()
+}
+
+func TestH2C(t *testing.T) {
+	serveSSE := New(&Config{Retry: time.Second * 3})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(makeHandler(serveSSE)))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+	expectStream(t, serveSSE, &http.Client{Transport: transport}, server.URL, 2)
+	serveSSE.Close()
+}
+
+func TestWrappedWriter(t *testing.T) {
+	serveSSE := New(&Config{
+		Retry:        time.Second * 3,
+		WriteTimeout: time.Second,
+	})
+	handler := makeHandler(serveSSE)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(&loggingWriter{w: w}, r)
+	}))
+	// Write timeout of server does not close stream
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Start()
+	defer server.Close()
+	expectStream(t, serveSSE, server.Client(), server.URL, 1)
+	serveSSE.Close()
+}
+
+func TestWriterWithoutFlush(t *testing.T) {
+	serveSSE := New(&Config{Retry: time.Second * 3})
+	handler := makeHandler(serveSSE)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(plainWriter{w}, r)
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected: 500\ngot: %d", resp.StatusCode)
+	}
+	serveSSE.Close()
+}